@@ -3,33 +3,43 @@
 
 // TODO:
 // - Test netdev.*NetDev.Traffic + $HOST_PROC.
-// - Add proper logging.
-// - Test netdev's logging.
-// - Once layer8co/toolbox/container/ringbuf is ready, use it in netdev for storing samples instead of the []int64.
+// - Once layer8co/toolbox/container/ringbuf is ready, use it in series instead of its own ring buffer.
 // - Implement a generic bucketed pool in layer8co/toolbox and use that in rcu.*BufferRcu instead of sync.Pool.
 // - Move rcu to layer8co/toolbox.
 
 package main
 
 import (
-	"bytes"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/config"
+	"github.com/layer8co/netexp/internal/container"
+	"github.com/layer8co/netexp/internal/expfmt"
 	"github.com/layer8co/netexp/internal/metrics"
 	"github.com/layer8co/netexp/internal/netdev"
 	"github.com/layer8co/netexp/internal/rcu"
+	"github.com/layer8co/netexp/internal/state"
+	"github.com/layer8co/netexp/internal/web"
 )
 
 const (
 	appName  = "netexp"
 	helpText = "netexp is a Prometheus exporter that provides advanced network usage metrics."
+
+	// Longest wait between retries of a failing collection.
+	maxBackoff = 30 * time.Second
 )
 
 var (
@@ -43,6 +53,42 @@ var (
 		netdev.IfacePattern,
 		"regexp to match network interface names",
 	)
+	ifaceModeFlag = flag.String(
+		"iface-mode",
+		config.IfaceModeRegexp.String(),
+		"collect the interfaces matched by -iface-regexp (regexp), or the ones that carry a default route (default-route)",
+	)
+	aggregationFlag = flag.String(
+		"aggregation",
+		netdev.AggregateAll.String(),
+		"of the matched interfaces stacked on each other, like bonds, bridges and VLANs,\n"+
+			"collect all (all), only the top-level ones (top-level), or only the bottom ones (physical)",
+	)
+	sourceFlag = flag.String(
+		"source",
+		netdev.BackendProcfs.String(),
+		"read the counters of the interfaces from /proc/net/dev (procfs), or over rtnetlink (netlink), which is cheaper but can't be used with -all-netns",
+	)
+	allNetns = flag.Bool(
+		"all-netns",
+		false,
+		"collect the interfaces of every network namespace, with a netns label (needs root, and the host's /proc as $HOST_PROC in a container)",
+	)
+	vethPeers = flag.Bool(
+		"veth-peers",
+		false,
+		"label matched veth interfaces with the interface and network namespace of their peer, and its container with -container-labels",
+	)
+	containerLabels = flag.Bool(
+		"container-labels",
+		false,
+		"with -all-netns or -veth-peers, label the interfaces of containers with their container_id, pod and namespace, from their cgroups",
+	)
+	containerBundleDirs = flag.String(
+		"container-labels.bundle-dirs",
+		strings.Join(container.DefaultBundleDirs, ","),
+		"comma-separated directories of the host with the OCI bundles of containers, to find the pod names and namespaces in their annotations",
+	)
 	interval = flag.Duration(
 		"interval",
 		time.Second,
@@ -58,11 +104,102 @@ var (
 		"15s,30s,60s",
 		"comma-separated output window durations",
 	)
+	quantilesFlag = flag.String(
+		"quantiles",
+		"",
+		"comma-separated quantiles of the burst rates to export alongside the maximum (e.g. 0.5,0.9,0.99)",
+	)
+	billingFlag = flag.Bool(
+		"billing",
+		false,
+		"export the 95th percentile of the 5-minute average rates over the current and previous billing periods",
+	)
+	billingAnchorDay = flag.Int(
+		"billing.anchor-day",
+		billing.DefaultAnchorDay,
+		"day of the month that billing periods start on, in local time (1 to 28)",
+	)
+	billingPercentile = flag.Float64(
+		"billing.percentile",
+		billing.DefaultPercentile,
+		"percentile of the 5-minute average rates that is billed",
+	)
+	linkSpeedsFlag = flag.String(
+		"link-speeds",
+		"",
+		"comma-separated link speeds in bits per second overriding those of /sys/class/net, as iface=speed (e.g. veth0=10G);\n"+
+			"the total has no speed nor utilization while a matched interface that isn't down has none",
+	)
+	accountingFlag = flag.Bool(
+		"accounting",
+		false,
+		"export the bytes received and transmitted in the current day and month",
+	)
+	accountingMonthStartDay = flag.Int(
+		"accounting.month-start-day",
+		metrics.DefaultMonthStartDay,
+		"day of the month that months start on, in local time (1 to 28)",
+	)
+	accountingMonthlyQuota = flag.String(
+		"accounting.monthly-quota",
+		"",
+		"bytes that may be received and transmitted in a month (e.g. 50GB), to export the fraction used",
+	)
+	legacyNames = flag.Bool(
+		"compat.legacy-names",
+		false,
+		"export the original metric names with the durations in the name (e.g. netexp_max_1s_recv_burst_bps_over_1m0s)",
+	)
+	breakdownFlag = flag.String(
+		"breakdown",
+		metrics.BreakdownTotal.String(),
+		"export the sum of matched interfaces (total), each interface with an iface label (iface), or both",
+	)
+	webConfigFile = flag.String(
+		"web.config.file",
+		"",
+		"web configuration file enabling TLS and basic auth, like that of the Prometheus exporter-toolkit",
+	)
+	configFile = flag.String(
+		"config.file",
+		"",
+		"YAML configuration file, whose settings override the flags; reloaded on SIGHUP",
+	)
+	stateFile = flag.String(
+		"state.file",
+		"",
+		"file to save the series to periodically and on shutdown, and to restore them from on startup",
+	)
+	stateSaveInterval = flag.Duration(
+		"state.save-interval",
+		time.Minute,
+		"how often to save the series to -state.file",
+	)
+	logLevelFlag = flag.String(
+		"log.level",
+		"info",
+		"only log messages of this level or above (debug, info, warn, error)",
+	)
+	logFormatFlag = flag.String(
+		"log.format",
+		"logfmt",
+		"log format (logfmt, json)",
+	)
 )
 
+var bursts burstsFlag
+
+func init() {
+	flag.Var(
+		&bursts,
+		"burst",
+		"burst and output windows of other counters as counters:burst-windows:output-windows\n"+
+			"(e.g. packets:1s:60s or recv_drop,trns_drop:5s:5m); may be repeated",
+	)
+}
+
 var (
-	appRcu     = rcu.NewBufferRcu()
-	appNetDev  *netdev.NetDev
+	appRcu     [expfmt.NumFormats]*rcu.BufferRcu // Rendered metrics of each format.
 	appMetrics *metrics.Metrics
 )
 
@@ -75,73 +212,360 @@ func main() {
 
 	flag.Parse()
 
-	ifaceRegexp, err := regexp.Compile(*ifaceRegexpFlag)
+	handler, err := newLogHandler(*logLevelFlag, *logFormatFlag)
 	if err != nil {
-		die(fmt.Sprintf("-iface-regexp parse erorr: %s", err))
+		die(err.Error())
 	}
+	slog.SetDefault(slog.New(handler))
 
-	appNetDev = netdev.New(ifaceRegexp.Match, func(fn func(io.Writer)) {
-		b := new(bytes.Buffer)
-		fn(b)
-		fmt.Printf("%s\n", b.Bytes())
-	})
+	for f := range appRcu {
+		appRcu[f] = rcu.NewBufferRcu()
+	}
 
-	appMetrics = metrics.New(metrics.Config{
-		Interval:      *interval,
-		BurstWindows:  mustGet(parseDurations(*burstWindowsFlag)),
-		OutputWindows: mustGet(parseDurations(*outputWindowsFlag)),
-	})
+	settings, err := loadSettings()
+	if err != nil {
+		die(err.Error())
+	}
+	source := apply(settings)
+	if *stateFile != "" {
+		restoreState()
+	}
+
+	reloads := make(chan config.Settings)
+	go watchReloads(reloads)
 
-	fmt.Printf("listening on %s\n", *listen)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	slog.Info("listening", "address", *listen)
 
 	go func() {
-		mustDo(gatherMetrics())
+		mustDo(serveHttp(handler))
 	}()
 
-	serveHttp()
+	gatherMetrics(source, reloads, stop)
 }
 
-func serveHttp() error {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func serveHttp(handler slog.Handler) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, appName)
 	})
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		appRcu.Read(func(b []byte) {
-			w.Write(b)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		f := expfmt.Negotiate(r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", f.ContentType())
+		appRcu[f].Read(func(b []byte) {
+			_, err := w.Write(b)
+			if err != nil {
+				slog.Debug("could not write metrics", "remote", r.RemoteAddr, "err", err)
+			}
 		})
 	})
-	return http.ListenAndServe(*listen, nil)
+	server := &http.Server{
+		Addr:     *listen,
+		Handler:  mux,
+		ErrorLog: slog.NewLogLogger(handler, slog.LevelError),
+	}
+	var err error
+	if *webConfigFile == "" {
+		err = server.ListenAndServe()
+	} else {
+		var s *web.Server
+		s, err = web.NewServer(*webConfigFile)
+		if err == nil {
+			err = s.ListenAndServe(server)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not serve http: %w", err)
+	}
+	return nil
+}
+
+// loadSettings returns the settings given by the flags,
+// overridden by the configuration file if there is one.
+func loadSettings() (s config.Settings, err error) {
+	s.IfaceMode, err = config.ParseIfaceMode(*ifaceModeFlag)
+	if err != nil {
+		return s, fmt.Errorf("-iface-mode parse error: %w", err)
+	}
+	s.IfaceRegexp, err = regexp.Compile(*ifaceRegexpFlag)
+	if err != nil {
+		return s, fmt.Errorf("-iface-regexp parse error: %w", err)
+	}
+	s.Aggregation, err = netdev.ParseAggregation(*aggregationFlag)
+	if err != nil {
+		return s, fmt.Errorf("-aggregation parse error: %w", err)
+	}
+	s.Source, err = netdev.ParseBackend(*sourceFlag)
+	if err != nil {
+		return s, fmt.Errorf("-source parse error: %w", err)
+	}
+	s.Metrics.Breakdown, err = metrics.ParseBreakdown(*breakdownFlag)
+	if err != nil {
+		return s, fmt.Errorf("-breakdown parse error: %w", err)
+	}
+	s.Metrics.BurstWindows, err = metrics.ParseDurations(*burstWindowsFlag)
+	if err != nil {
+		return s, fmt.Errorf("-burst-windows parse error: %w", err)
+	}
+	s.Metrics.OutputWindows, err = metrics.ParseDurations(*outputWindowsFlag)
+	if err != nil {
+		return s, fmt.Errorf("-output-windows parse error: %w", err)
+	}
+	s.Metrics.Quantiles, err = metrics.ParseQuantiles(*quantilesFlag)
+	if err != nil {
+		return s, fmt.Errorf("-quantiles parse error: %w", err)
+	}
+	s.Metrics.LinkSpeeds, err = metrics.ParseLinkSpeeds(*linkSpeedsFlag)
+	if err != nil {
+		return s, fmt.Errorf("-link-speeds parse error: %w", err)
+	}
+	s.Metrics.Interval = *interval
+	s.Metrics.Bursts = bursts
+	s.Metrics.LegacyNames = *legacyNames
+	s.AllNetns = *allNetns
+	s.VethPeers = *vethPeers
+	if *containerLabels {
+		s.Containers = &config.Containers{}
+		if *containerBundleDirs != "" {
+			s.Containers.BundleDirs = strings.Split(*containerBundleDirs, ",")
+		}
+	}
+	if *accountingFlag {
+		s.Metrics.Accounting = &metrics.Accounting{
+			MonthStartDay: *accountingMonthStartDay,
+			Location:      time.Local,
+		}
+		if *accountingMonthlyQuota != "" {
+			s.Metrics.Accounting.MonthlyQuota, err = metrics.ParseBytes(*accountingMonthlyQuota)
+			if err != nil {
+				return s, fmt.Errorf("-accounting.monthly-quota parse error: %w", err)
+			}
+		}
+	}
+	if *billingFlag {
+		s.Metrics.Billing = &billing.Config{
+			Percentile: *billingPercentile,
+			AnchorDay:  *billingAnchorDay,
+			Location:   time.Local,
+		}
+	}
+	if *configFile == "" {
+		return s, s.Validate()
+	}
+	f, err := config.Load(*configFile)
+	if err != nil {
+		return s, err
+	}
+	err = f.Apply(&s)
+	if err != nil {
+		return s, fmt.Errorf("invalid config file %q: %w", *configFile, err)
+	}
+	return s, nil
+}
+
+// apply replaces the metrics with ones built from s, and returns the source
+// of the interface counters for s, leaving it to the caller to close the previous one.
+// The series collected so far are carried over where they fit the new settings.
+func apply(s config.Settings) netdev.Source {
+	match := s.IfaceRegexp.Match
+	var routes *netdev.DefaultRoutes
+	if s.IfaceMode == config.IfaceModeDefaultRoute {
+		routes = netdev.NewDefaultRoutes(slog.Default())
+		match = routes.Match
+	}
+	d := netdev.New(match, slog.Default())
+	d.SetAggregation(s.Aggregation)
+	d.SetAllNetns(s.AllNetns)
+	d.SetPeers(s.VethPeers)
+	if s.Containers != nil {
+		d.SetContainers(container.NewResolver(netdev.HostProc(), s.Containers.BundleDirs))
+	}
+	source := netdev.NewSource(d, s.Source)
+	if routes != nil {
+		source = routedSource{Source: source, routes: routes}
+	}
+	prev := appMetrics
+	appMetrics = metrics.New(s.Metrics)
+	if prev != nil {
+		err := appMetrics.Restore(prev.State())
+		if err != nil {
+			slog.Warn("could not carry series over to the new configuration", "err", err)
+		}
+	}
+	return source
+}
+
+// restoreState restores the metrics from -state.file.
+func restoreState() {
+	f, err := state.Load(*stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("no state to restore", "file", *stateFile)
+		return
+	}
+	if err == nil && f.Metrics != nil {
+		err = appMetrics.Restore(f.Metrics)
+	}
+	if err != nil {
+		slog.Warn("could not restore state", "file", *stateFile, "err", err)
+		return
+	}
+	slog.Info("restored state", "file", *stateFile, "saved", f.Saved)
+}
+
+// saveState saves the metrics to -state.file.
+func saveState() {
+	err := state.Save(*stateFile, &state.File{
+		Saved:   time.Now(),
+		Metrics: appMetrics.State(),
+	})
+	if err != nil {
+		slog.Error("could not save state", "file", *stateFile, "err", err)
+	}
+}
+
+// watchReloads sends the settings to reloads every time netexp receives SIGHUP.
+// Invalid settings are logged and not sent.
+func watchReloads(reloads chan<- config.Settings) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		s, err := loadSettings()
+		if err != nil {
+			slog.Error("could not reload configuration", "err", err)
+			continue
+		}
+		reloads <- s
+		slog.Info("configuration reloaded")
+	}
+}
+
+// routedSource is a Source that reads the routing tables before each read
+// with -iface-mode=default-route, so that the interfaces follow changes to the default routes.
+type routedSource struct {
+	netdev.Source
+	routes *netdev.DefaultRoutes
+}
+
+func (s routedSource) Read() (netdev.Snapshot, error) {
+	err := s.routes.Update()
+	if err != nil {
+		return netdev.Snapshot{}, err
+	}
+	return s.Source.Read()
 }
 
-func gatherMetrics() error {
-	for ; true; <-time.Tick(*interval) {
-		recv, trns, err := appNetDev.Traffic()
+// gatherMetrics collects the interface counters from source every interval.
+// When collection fails, e.g. while /proc is being remounted,
+// it is retried with exponential backoff,
+// and the metrics report the failure in the meantime.
+// Settings received from reloads take effect immediately, with a new source.
+// The series are saved every -state.save-interval, and when netexp is stopped,
+// after which gatherMetrics returns.
+func gatherMetrics(source netdev.Source, reloads <-chan config.Settings, stop <-chan os.Signal) {
+	defer func() { source.Close() }()
+	interval := appMetrics.Interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var saves <-chan time.Time
+	if *stateFile != "" {
+		saveTicker := time.NewTicker(*stateSaveInterval)
+		defer saveTicker.Stop()
+		saves = saveTicker.C
+	}
+	var backoff time.Duration
+	for {
+		var wait <-chan time.Time
+		snap, err := source.Read()
 		if err != nil {
-			return err
+			backoff = min(max(2*backoff, interval), max(maxBackoff, interval))
+			slog.Error("could not collect interface counters", "retry_in", backoff, "err", err)
+			appMetrics.Fail()
+			publishMetrics()
+			wait = time.After(backoff)
+		} else {
+			if backoff > 0 {
+				slog.Info("collection of interface counters recovered")
+				backoff = 0
+			}
+			appMetrics.Step(snap.Time, snap.Ifaces)
+			publishMetrics()
+			wait = ticker.C
 		}
-		appRcu.Update(func(b []byte) ([]byte, error) {
-			b = appMetrics.Step(recv, trns, b)
+	waiting:
+		for {
+			select {
+			case <-wait:
+				break waiting
+			case <-saves:
+				saveState()
+			case s := <-reloads:
+				source.Close()
+				source = apply(s)
+				interval = appMetrics.Interval
+				ticker.Reset(interval)
+				backoff = 0
+				break waiting
+			case sig := <-stop:
+				slog.Info("stopping", "signal", sig)
+				if *stateFile != "" {
+					saveState()
+				}
+				return
+			}
+		}
+	}
+}
+
+// publishMetrics renders the metrics in every format for the /metrics handler.
+func publishMetrics() {
+	for f, r := range appRcu {
+		r.Update(func(b []byte) ([]byte, error) {
+			b = appMetrics.Append(b, expfmt.Format(f))
 			b = append(b, '\n')
 			return b, nil
 		})
 	}
+}
+
+// burstsFlag collects the values of the repeatable -burst flag.
+type burstsFlag []metrics.Burst
+
+func (f *burstsFlag) String() string {
+	return ""
+}
+
+func (f *burstsFlag) Set(s string) error {
+	b, err := metrics.ParseBurst(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, b)
 	return nil
 }
 
-func parseDurations(s string) (out []time.Duration, err error) {
-	for field := range strings.SplitSeq(s, ",") {
-		field = strings.TrimSpace(field)
-		d, err := time.ParseDuration(field)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse duration %q: %w", field, err)
-		}
-		out = append(out, d)
+// newLogHandler returns a handler that writes to stderr
+// in the given format, dropping messages below the given level.
+func newLogHandler(level, format string) (slog.Handler, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("-log.level parse error: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "logfmt":
+		return slog.NewTextHandler(os.Stderr, opts), nil
+	case "json":
+		return slog.NewJSONHandler(os.Stderr, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown -log.format %q", format)
 	}
-	return out, nil
 }
 
 func die(s string) {
-	fmt.Println(s)
+	slog.Error(s)
 	os.Exit(1)
 }
 
@@ -150,8 +574,3 @@ func mustDo(err error) {
 		die(err.Error())
 	}
 }
-
-func mustGet[T any](v T, err error) T {
-	mustDo(err)
-	return v
-}
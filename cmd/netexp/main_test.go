@@ -0,0 +1,110 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/layer8co/netexp/internal/config"
+	"github.com/layer8co/netexp/internal/expfmt"
+	"github.com/layer8co/netexp/internal/metrics"
+	"github.com/layer8co/netexp/internal/netdev"
+	"github.com/layer8co/netexp/internal/rcu"
+)
+
+// fakeSource returns its snapshots or errors in turn,
+// keeping the metrics published before each read,
+// and stops gatherMetrics after the last one, which it repeats
+// in case a tick is taken before the stop.
+type fakeSource struct {
+	reads     []fakeRead
+	stop      chan<- os.Signal
+	published []string
+	closed    bool
+}
+
+type fakeRead struct {
+	snap netdev.Snapshot
+	err  error
+}
+
+func (s *fakeSource) Read() (netdev.Snapshot, error) {
+	if len(s.published) == len(s.reads) {
+		r := s.reads[len(s.reads)-1]
+		return r.snap, r.err
+	}
+	s.published = append(s.published, published())
+	if len(s.published) == len(s.reads) {
+		s.stop <- os.Interrupt
+	}
+	r := s.reads[len(s.published)-1]
+	return r.snap, r.err
+}
+
+func (s *fakeSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+// published returns the metrics published in the text format.
+func published() string {
+	var text string
+	appRcu[expfmt.FormatText].Read(func(b []byte) {
+		text = string(b)
+	})
+	return text
+}
+
+func snapshot(t time.Time, recv, trns int64) netdev.Snapshot {
+	return netdev.Snapshot{
+		Time: t,
+		Ifaces: []netdev.Iface{{
+			Name:  "eth0",
+			Stats: netdev.Stats{netdev.RecvBytes: recv, netdev.TrnsBytes: trns},
+		}},
+	}
+}
+
+func TestGatherMetrics(t *testing.T) {
+	for f := range appRcu {
+		appRcu[f] = rcu.NewBufferRcu()
+	}
+	appMetrics = metrics.New(metrics.Config{
+		Interval:      10 * time.Millisecond,
+		BurstWindows:  []time.Duration{10 * time.Millisecond},
+		OutputWindows: []time.Duration{20 * time.Millisecond},
+		Breakdown:     metrics.BreakdownIface,
+	})
+
+	now := time.Unix(1700000000, 0)
+	stop := make(chan os.Signal, 1)
+	source := &fakeSource{
+		reads: []fakeRead{
+			{snap: snapshot(now, 10, 20)},
+			{err: errors.New("/proc is gone")},
+			{snap: snapshot(now.Add(20*time.Millisecond), 30, 40)},
+		},
+		stop: stop,
+	}
+	gatherMetrics(source, make(chan config.Settings), stop)
+	require.Len(t, source.published, 3)
+	assert.True(t, source.closed)
+
+	assert.Contains(t, source.published[1], "netexp_up 1\n")
+	assert.Contains(t, source.published[1], `netexp_bytes_total{iface="eth0",direction="recv"} 10`+"\n")
+	// A failed read is reported until the next one succeeds.
+	assert.Contains(t, source.published[2], "netexp_up 0\n")
+	assert.NotContains(t, source.published[2], "netexp_bytes_total")
+
+	text := published()
+	assert.Contains(t, text, "netexp_up 1\n")
+	assert.Contains(t, text, `netexp_bytes_total{iface="eth0",direction="recv"} 30`+"\n")
+	assert.Contains(t, text, `netexp_bytes_total{iface="eth0",direction="trns"} 40`+"\n")
+}
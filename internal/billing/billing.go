@@ -0,0 +1,282 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+// Package billing computes the rates that burstable billing is based on:
+// a percentile, usually the 95th, of the 5-minute average rates
+// over a monthly billing period.
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/layer8co/netexp/internal/series"
+)
+
+// SampleInterval is the duration that rates are averaged over.
+// Samples are aligned to the wall clock, e.g. 12:00 to 12:05.
+const SampleInterval = 5 * time.Minute
+
+// maxPeriod is longer than any billing period, including a DST change.
+const maxPeriod = 32 * 24 * time.Hour
+
+// Directions of the rates, in the order of Rates.
+const (
+	Recv = iota
+	Trns
+	numDirections
+)
+
+// Rates are rates in bits per second, received and transmitted.
+type Rates [numDirections]int64
+
+// Defaults of Config.
+const (
+	DefaultPercentile = 0.95
+	DefaultAnchorDay  = 1
+)
+
+// MaxAnchorDay is the last day of the month that monthly periods may start on,
+// as every month has it.
+const MaxAnchorDay = 28
+
+// ValidAnchorDay reports whether monthly periods may start on day.
+func ValidAnchorDay(day int) bool {
+	return day >= 1 && day <= MaxAnchorDay
+}
+
+// PeriodStart returns the start of the monthly period that t is in,
+// for periods that start at midnight in loc on day anchorDay of each month.
+func PeriodStart(t time.Time, anchorDay int, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	if d < anchorDay {
+		m--
+	}
+	return time.Date(y, m, anchorDay, 0, 0, 0, 0, loc)
+}
+
+type Config struct {
+	// Percentile of the sampled rates that is billed, e.g. 0.95.
+	Percentile float64
+
+	// AnchorDay is the day of the month that billing periods start on, from 1 to 28.
+	AnchorDay int
+
+	// Location is the time zone of the start of billing periods.
+	// nil means UTC.
+	Location *time.Location
+}
+
+// Validate reports whether c is a valid billing configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	if !(c.Percentile > 0 && c.Percentile <= 1) {
+		errs = append(errs, fmt.Errorf("billing percentile %g is not between 0 and 1", c.Percentile))
+	}
+	if !ValidAnchorDay(c.AnchorDay) {
+		errs = append(errs, fmt.Errorf("billing anchor day %d is not between 1 and %d", c.AnchorDay, MaxAnchorDay))
+	}
+	return errors.Join(errs...)
+}
+
+// Billing samples the average rates of the received and transmitted bytes
+// every SampleInterval, and keeps the samples of the current billing period.
+type Billing struct {
+	Config
+
+	// Start and end of the current billing period.
+	start, end time.Time
+
+	// Sampled rates of the current period, in bits per second,
+	// and their percentile.
+	samples    [numDirections]*series.TimeSeries
+	current    Rates
+	hasCurrent bool
+
+	// Percentile of the previous period.
+	previous    Rates
+	hasPrevious bool
+
+	// Start of the sample in progress, and the counters at that time.
+	sampleTime  time.Time
+	sampleBytes [numDirections]int64
+	sampling    bool
+
+	// Arguments of series.TimeSeries.Quantiles.
+	percentile [1]float64
+	quantile   [1]int64
+}
+
+// New returns the billing of c, which has to be valid (see Config.Validate).
+func New(c Config) *Billing {
+	if c.Location == nil {
+		c.Location = time.UTC
+	}
+	return &Billing{
+		Config:     c,
+		percentile: [1]float64{c.Percentile},
+	}
+}
+
+// periodStart returns the start of the billing period that t is in.
+func (b *Billing) periodStart(t time.Time) time.Time {
+	return PeriodStart(t, b.AnchorDay, b.Location)
+}
+
+// startPeriod makes the billing period that t is in the current one.
+func (b *Billing) startPeriod(t time.Time) {
+	b.start = b.periodStart(t)
+	b.end = b.start.AddDate(0, 1, 0)
+	for i := range b.samples {
+		b.samples[i] = series.New(SampleInterval, maxPeriod)
+	}
+	b.hasCurrent = false
+}
+
+// Step records the cumulative byte counters received and transmitted at time t,
+// which must not decrease.
+// A sample is taken whenever t reaches the next SampleInterval.
+// Samples spanning less than half a sample interval, such as the first one,
+// or more than two, e.g. because netexp was stopped, are left out.
+func (b *Billing) Step(t time.Time, recv, trns int64) {
+	bytes := [numDirections]int64{recv, trns}
+	if b.start.IsZero() {
+		b.startPeriod(t)
+	}
+	if b.sampling {
+		slot := b.sampleTime.Truncate(SampleInterval)
+		if !t.Truncate(SampleInterval).After(slot) {
+			return
+		}
+		elapsed := t.Sub(b.sampleTime)
+		if elapsed >= SampleInterval/2 && elapsed <= 2*SampleInterval {
+			var rates Rates
+			for i := range rates {
+				rates[i] = int64(float64(bytes[i]-b.sampleBytes[i]) * 8 / elapsed.Seconds())
+			}
+			b.put(slot, rates)
+		}
+	}
+	b.sampleTime = t
+	b.sampleBytes = bytes
+	b.sampling = true
+}
+
+// put records the rates sampled in the interval starting at slot.
+func (b *Billing) put(slot time.Time, rates Rates) {
+	if slot.Before(b.start) {
+		return
+	}
+	for !slot.Before(b.end) {
+		b.previous, b.hasPrevious = b.current, b.hasCurrent
+		b.startPeriod(b.end)
+	}
+	missed := int(slot.Sub(b.start)/SampleInterval) - b.samples[0].Len()
+	if missed < 0 {
+		// The clock went back.
+		return
+	}
+	for i, s := range b.samples {
+		s.Skip(missed)
+		s.Put(rates[i])
+	}
+	b.update()
+}
+
+// update computes the billed rates of the current period.
+func (b *Billing) update() {
+	b.hasCurrent = false
+	for i, s := range b.samples {
+		if s.Len() == 0 {
+			return
+		}
+		d := time.Duration(s.Len()) * SampleInterval
+		b.hasCurrent = s.Quantiles(d, b.percentile[:], b.quantile[:])
+		b.current[i] = b.quantile[0]
+	}
+}
+
+// Current returns the billed rates of the current period so far,
+// and whether any sample has been taken in it.
+func (b *Billing) Current() (Rates, bool) {
+	return b.current, b.hasCurrent
+}
+
+// Previous returns the billed rates of the previous period,
+// and whether any sample was taken in it.
+func (b *Billing) Previous() (Rates, bool) {
+	return b.previous, b.hasPrevious
+}
+
+// State is the state of Billing, as saved across restarts.
+type State struct {
+	Percentile float64      `json:"percentile"`
+	Start      time.Time    `json:"start"`
+	Recv       series.State `json:"recv"`
+	Trns       series.State `json:"trns"`
+	Previous   *Rates       `json:"previous,omitempty"`
+
+	// The sample in progress, if the counters it started from are restored too.
+	Sample *Sample `json:"sample,omitempty"`
+}
+
+// Sample is the start of a sample in progress.
+type Sample struct {
+	Time  time.Time            `json:"time"`
+	Bytes [numDirections]int64 `json:"bytes"`
+}
+
+// State returns the state of b.
+func (b *Billing) State() *State {
+	st := &State{
+		Percentile: b.Percentile,
+		Start:      b.start,
+	}
+	if b.start.IsZero() {
+		return st
+	}
+	st.Recv = b.samples[Recv].State()
+	st.Trns = b.samples[Trns].State()
+	if b.hasPrevious {
+		previous := b.previous
+		st.Previous = &previous
+	}
+	if b.sampling {
+		st.Sample = &Sample{Time: b.sampleTime, Bytes: b.sampleBytes}
+	}
+	return st
+}
+
+// Restore restores the state of b, which has to be new, from st.
+// The rates of the previous period are left out if the percentile changed,
+// and nothing is restored if the anchor day changed.
+func (b *Billing) Restore(st *State) error {
+	if !b.start.IsZero() {
+		panic("Billing.Restore: billing already has samples")
+	}
+	if st.Start.IsZero() {
+		return nil
+	}
+	if !b.periodStart(st.Start).Equal(st.Start) {
+		return fmt.Errorf("billing period of the saved state starts on %s, not on day %d", st.Start.Format(time.DateOnly), b.AnchorDay)
+	}
+	b.startPeriod(st.Start)
+	for i, s := range [numDirections]series.State{st.Recv, st.Trns} {
+		err := b.samples[i].Restore(s)
+		if err != nil {
+			b.startPeriod(st.Start)
+			return fmt.Errorf("could not restore billing samples: %w", err)
+		}
+	}
+	b.update()
+	if st.Previous != nil && st.Percentile == b.Percentile {
+		b.previous, b.hasPrevious = *st.Previous, true
+	}
+	if st.Sample != nil {
+		b.sampleTime = st.Sample.Time
+		b.sampleBytes = st.Sample.Bytes
+		b.sampling = true
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package billing_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/layer8co/netexp/internal/billing"
+)
+
+func TestBilling(t *testing.T) {
+	c := billing.Config{Percentile: 0.95, AnchorDay: 15}
+	b := billing.New(c)
+
+	// A day of 1000 bytes per second received and 100 transmitted,
+	// with 10 bursts of 5 minutes at 10 times the rate,
+	// which are within the top 5% of the 288 samples.
+	start := time.Date(2023, 10, 14, 0, 0, 0, 0, time.UTC)
+	var recv, trns int64
+	now := start
+	for now.Before(start.Add(24 * time.Hour)) {
+		b.Step(now, recv, trns)
+		rate := int64(1000)
+		if now.Sub(start) < 10*billing.SampleInterval {
+			rate *= 10
+		}
+		recv += rate * 60
+		trns += rate / 10 * 60
+		now = now.Add(time.Minute)
+	}
+	b.Step(now, recv, trns)
+
+	current, ok := b.Current()
+	require.True(t, ok)
+	assert.Equal(t, billing.Rates{8000, 800}, current)
+	_, ok = b.Previous()
+	assert.False(t, ok)
+
+	// Saved and restored across a restart.
+	r := billing.New(c)
+	require.NoError(t, r.Restore(b.State()))
+	restored, ok := r.Current()
+	require.True(t, ok)
+	assert.Equal(t, current, restored)
+
+	// The first sample of the next period, which starts on the 15th,
+	// moves the rates of this one to the previous period.
+	for range 5 {
+		now = now.Add(time.Minute)
+		recv += 2000 * 60
+		r.Step(now, recv, trns)
+	}
+	previous, ok := r.Previous()
+	require.True(t, ok)
+	assert.Equal(t, current, previous)
+	current, ok = r.Current()
+	require.True(t, ok)
+	assert.Equal(t, billing.Rates{16000, 0}, current)
+}
+
+func TestBilling_Gap(t *testing.T) {
+	b := billing.New(billing.Config{Percentile: 0.95, AnchorDay: 1})
+	now := time.Date(2023, 10, 14, 0, 0, 0, 0, time.UTC)
+	b.Step(now, 0, 0)
+	// Too long a sample isn't taken.
+	now = now.Add(time.Hour)
+	b.Step(now, 1e9, 1e9)
+	_, ok := b.Current()
+	assert.False(t, ok)
+
+	now = now.Add(billing.SampleInterval)
+	b.Step(now, 1e9+300, 1e9)
+	current, ok := b.Current()
+	require.True(t, ok)
+	assert.Equal(t, billing.Rates{8, 0}, current)
+}
+
+func TestBilling_RestoreAnchorDay(t *testing.T) {
+	b := billing.New(billing.Config{Percentile: 0.95, AnchorDay: 1})
+	b.Step(time.Date(2023, 10, 14, 0, 0, 0, 0, time.UTC), 0, 0)
+	r := billing.New(billing.Config{Percentile: 0.95, AnchorDay: 15})
+	assert.Error(t, r.Restore(b.State()))
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, c := range []billing.Config{
+		{Percentile: 0, AnchorDay: 1},
+		{Percentile: 1.5, AnchorDay: 1},
+		{Percentile: 0.95, AnchorDay: 0},
+		{Percentile: 0.95, AnchorDay: 29},
+	} {
+		assert.Error(t, c.Validate(), "%+v", c)
+	}
+	c := billing.Config{Percentile: 0.95, AnchorDay: 28}
+	assert.NoError(t, c.Validate())
+}
+
+func TestPeriodStart(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	tests := []struct {
+		t         time.Time
+		anchorDay int
+		want      time.Time
+	}{
+		{time.Date(2023, 10, 14, 12, 0, 0, 0, loc), 1, time.Date(2023, 10, 1, 0, 0, 0, 0, loc)},
+		{time.Date(2023, 10, 14, 12, 0, 0, 0, loc), 15, time.Date(2023, 9, 15, 0, 0, 0, 0, loc)},
+		{time.Date(2023, 10, 15, 0, 0, 0, 0, loc), 15, time.Date(2023, 10, 15, 0, 0, 0, 0, loc)},
+		{time.Date(2024, 1, 10, 0, 0, 0, 0, loc), 28, time.Date(2023, 12, 28, 0, 0, 0, 0, loc)},
+		// Still the 14th in UTC, but already the 15th in loc.
+		{time.Date(2023, 10, 14, 22, 0, 0, 0, time.UTC), 15, time.Date(2023, 10, 15, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		got := billing.PeriodStart(tt.t, tt.anchorDay, loc)
+		assert.True(t, tt.want.Equal(got), "%s, day %d: got %s, want %s", tt.t, tt.anchorDay, got, tt.want)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+// Package config reads netexp's configuration file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/metrics"
+	"github.com/layer8co/netexp/internal/netdev"
+	"github.com/layer8co/netexp/internal/series"
+)
+
+// File is the content of a configuration file.
+// Settings that are left out keep the value given by the flags.
+type File struct {
+	IfaceMode     string          `yaml:"iface_mode"`
+	IfaceRegexp   string          `yaml:"iface_regexp"`
+	Aggregation   string          `yaml:"aggregation"`
+	Source        string          `yaml:"source"`
+	AllNetns      *bool           `yaml:"all_netns"`
+	VethPeers     *bool           `yaml:"veth_peers"`
+	Containers    *Containers     `yaml:"containers"`
+	Interval      time.Duration   `yaml:"interval"`
+	BurstWindows  []time.Duration `yaml:"burst_windows"`
+	OutputWindows []time.Duration `yaml:"output_windows"`
+	Quantiles     []float64       `yaml:"quantiles"`
+	Breakdown     string          `yaml:"breakdown"`
+	LegacyNames   *bool           `yaml:"legacy_names"`
+
+	// Bursts replace the ones given with -burst.
+	Bursts []Burst `yaml:"bursts"`
+
+	Groups []Group `yaml:"groups"`
+
+	Tiers []Tier `yaml:"tiers"`
+
+	// Billing enables burstable billing, even if the flags don't.
+	Billing *Billing `yaml:"billing"`
+
+	// LinkSpeeds are added to the ones given with -link-speeds,
+	// e.g. {veth0: 10G}.
+	LinkSpeeds map[string]string `yaml:"link_speeds"`
+
+	// Accounting enables the day and month totals, even if the flags don't.
+	Accounting *Accounting `yaml:"accounting"`
+}
+
+// Burst is a set of burst and output windows of some counters.
+type Burst struct {
+	// Counter names (e.g. recv_drop) or kinds (e.g. packets).
+	// Defaults to bytes.
+	Counters      []string        `yaml:"counters"`
+	BurstWindows  []time.Duration `yaml:"burst_windows"`
+	OutputWindows []time.Duration `yaml:"output_windows"`
+}
+
+// Group is a named sum of the interfaces matched by a regexp.
+type Group struct {
+	Name        string `yaml:"name"`
+	IfaceRegexp string `yaml:"iface_regexp"`
+}
+
+// Tier is a resolution at which burst series are kept, and for how long.
+type Tier struct {
+	Resolution time.Duration `yaml:"resolution"`
+	Retention  time.Duration `yaml:"retention"`
+}
+
+// Billing is the billing period and percentile of burstable billing.
+// Settings that are left out keep the value given by the flags if they enable billing,
+// or else the default.
+type Billing struct {
+	AnchorDay  int     `yaml:"anchor_day"`
+	Percentile float64 `yaml:"percentile"`
+}
+
+// Accounting is the start of months and the monthly quota of the day and month totals.
+// Settings that are left out keep the value given by the flags if they enable accounting,
+// or else the default.
+type Accounting struct {
+	MonthStartDay int    `yaml:"month_start_day"`
+	MonthlyQuota  string `yaml:"monthly_quota"` // e.g. 50GB.
+}
+
+// Containers enables the labels of the containers of network namespaces.
+// Settings that are left out keep the value given by the flags if they enable the labels,
+// or else the default.
+type Containers struct {
+	// BundleDirs are the directories of the host with the OCI bundles of containers,
+	// container.DefaultBundleDirs if empty.
+	BundleDirs []string `yaml:"bundle_dirs"`
+}
+
+// Settings are the settings that can be given both by flags and by the file.
+type Settings struct {
+	IfaceMode   IfaceMode
+	IfaceRegexp *regexp.Regexp
+	Aggregation netdev.Aggregation
+	Source      netdev.Backend
+	AllNetns    bool
+	VethPeers   bool
+	// Containers is nil unless the containers of network namespaces are resolved.
+	Containers *Containers
+	Metrics    metrics.Config
+}
+
+// IfaceMode selects how the interfaces to collect are chosen.
+type IfaceMode int
+
+const (
+	// IfaceModeRegexp collects the interfaces matched by the interface regexp.
+	IfaceModeRegexp IfaceMode = iota
+	// IfaceModeDefaultRoute collects the interfaces that carry a default route.
+	IfaceModeDefaultRoute
+)
+
+var ifaceModeNames = []string{
+	IfaceModeRegexp:       "regexp",
+	IfaceModeDefaultRoute: "default-route",
+}
+
+func (m IfaceMode) String() string {
+	if int(m) < len(ifaceModeNames) {
+		return ifaceModeNames[m]
+	}
+	return fmt.Sprintf("IfaceMode(%d)", int(m))
+}
+
+func ParseIfaceMode(s string) (IfaceMode, error) {
+	i := slices.Index(ifaceModeNames, s)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown interface mode %q", s)
+	}
+	return IfaceMode(i), nil
+}
+
+// Load reads the configuration file at path.
+// Unknown keys are reported as errors, so that typos don't go unnoticed.
+func Load(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	f, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %q: %w", path, err)
+	}
+	return f, nil
+}
+
+// Parse parses the content of a configuration file.
+func Parse(b []byte) (*File, error) {
+	f := new(File)
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	err := d.Decode(f)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Apply overrides s with the settings given in f, and validates the result.
+func (f *File) Apply(s *Settings) (err error) {
+	if f.IfaceMode != "" {
+		s.IfaceMode, err = ParseIfaceMode(f.IfaceMode)
+		if err != nil {
+			return fmt.Errorf("iface_mode: %w", err)
+		}
+	}
+	if f.IfaceRegexp != "" {
+		s.IfaceRegexp, err = regexp.Compile(f.IfaceRegexp)
+		if err != nil {
+			return fmt.Errorf("iface_regexp: %w", err)
+		}
+	}
+	if f.Aggregation != "" {
+		s.Aggregation, err = netdev.ParseAggregation(f.Aggregation)
+		if err != nil {
+			return fmt.Errorf("aggregation: %w", err)
+		}
+	}
+	if f.Source != "" {
+		s.Source, err = netdev.ParseBackend(f.Source)
+		if err != nil {
+			return fmt.Errorf("source: %w", err)
+		}
+	}
+	if f.AllNetns != nil {
+		s.AllNetns = *f.AllNetns
+	}
+	if f.VethPeers != nil {
+		s.VethPeers = *f.VethPeers
+	}
+	if f.Containers != nil {
+		var c Containers
+		if s.Containers != nil {
+			c = *s.Containers
+		}
+		if f.Containers.BundleDirs != nil {
+			c.BundleDirs = f.Containers.BundleDirs
+		}
+		s.Containers = &c
+	}
+	c := &s.Metrics
+	if f.Interval != 0 {
+		c.Interval = f.Interval
+	}
+	if f.BurstWindows != nil {
+		c.BurstWindows = f.BurstWindows
+	}
+	if f.OutputWindows != nil {
+		c.OutputWindows = f.OutputWindows
+	}
+	if f.Quantiles != nil {
+		c.Quantiles = f.Quantiles
+	}
+	if f.Breakdown != "" {
+		c.Breakdown, err = metrics.ParseBreakdown(f.Breakdown)
+		if err != nil {
+			return fmt.Errorf("breakdown: %w", err)
+		}
+	}
+	if f.LegacyNames != nil {
+		c.LegacyNames = *f.LegacyNames
+	}
+	if f.Bursts != nil {
+		c.Bursts = nil
+		for i, b := range f.Bursts {
+			counters := b.Counters
+			if len(counters) == 0 {
+				counters = []string{"bytes"}
+			}
+			parsed, err := metrics.ParseCounters(counters)
+			if err != nil {
+				return fmt.Errorf("bursts[%d]: %w", i, err)
+			}
+			c.Bursts = append(c.Bursts, metrics.Burst{
+				Counters:      parsed,
+				BurstWindows:  b.BurstWindows,
+				OutputWindows: b.OutputWindows,
+			})
+		}
+	}
+	if f.Groups != nil {
+		c.Groups = nil
+		for i, g := range f.Groups {
+			group := metrics.Group{Name: g.Name}
+			if g.IfaceRegexp != "" {
+				group.Ifaces, err = regexp.Compile(g.IfaceRegexp)
+				if err != nil {
+					return fmt.Errorf("groups[%d]: iface_regexp: %w", i, err)
+				}
+			}
+			c.Groups = append(c.Groups, group)
+		}
+	}
+	if f.Tiers != nil {
+		c.Tiers = nil
+		for _, t := range f.Tiers {
+			c.Tiers = append(c.Tiers, series.Tier(t))
+		}
+	}
+	if f.LinkSpeeds != nil {
+		speeds := maps.Clone(c.LinkSpeeds)
+		if speeds == nil {
+			speeds = make(map[string]int64)
+		}
+		for name, speed := range f.LinkSpeeds {
+			speeds[name], err = metrics.ParseSpeed(speed)
+			if err != nil {
+				return fmt.Errorf("link_speeds: %w", err)
+			}
+		}
+		c.LinkSpeeds = speeds
+	}
+	if f.Billing != nil {
+		b := billing.Config{
+			Percentile: billing.DefaultPercentile,
+			AnchorDay:  billing.DefaultAnchorDay,
+			Location:   time.Local,
+		}
+		if c.Billing != nil {
+			b = *c.Billing
+		}
+		if f.Billing.AnchorDay != 0 {
+			b.AnchorDay = f.Billing.AnchorDay
+		}
+		if f.Billing.Percentile != 0 {
+			b.Percentile = f.Billing.Percentile
+		}
+		c.Billing = &b
+	}
+	if f.Accounting != nil {
+		a := metrics.Accounting{MonthStartDay: metrics.DefaultMonthStartDay, Location: time.Local}
+		if c.Accounting != nil {
+			a = *c.Accounting
+		}
+		if f.Accounting.MonthStartDay != 0 {
+			a.MonthStartDay = f.Accounting.MonthStartDay
+		}
+		if f.Accounting.MonthlyQuota != "" {
+			a.MonthlyQuota, err = metrics.ParseBytes(f.Accounting.MonthlyQuota)
+			if err != nil {
+				return fmt.Errorf("accounting: monthly_quota: %w", err)
+			}
+		}
+		c.Accounting = &a
+	}
+	return s.Validate()
+}
+
+// Validate reports whether s is valid.
+func (s *Settings) Validate() error {
+	if s.Source == netdev.BackendNetlink && s.AllNetns {
+		return errors.New("every network namespace can only be collected from procfs")
+	}
+	if s.Containers != nil && !s.AllNetns && !s.VethPeers {
+		return errors.New("container labels need every network namespace or veth peers")
+	}
+	return s.Metrics.Validate()
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/metrics"
+	"github.com/layer8co/netexp/internal/netdev"
+	"github.com/layer8co/netexp/internal/series"
+)
+
+func TestApply(t *testing.T) {
+	f, err := Parse([]byte(`
+interval: 500ms
+iface_mode: default-route
+iface_regexp: ^eth\d+$
+aggregation: top-level
+all_netns: true
+veth_peers: true
+containers:
+  bundle_dirs: [/run/containerd/io.containerd.runtime.v2.task/k8s.io]
+legacy_names: false
+quantiles: [0.5, 0.99]
+bursts:
+  - burst_windows: [1s]
+    output_windows: [1m]
+  - counters: [packets, recv_drop]
+    burst_windows: [5m]
+    output_windows: [1h, 24h]
+groups:
+  - name: uplink
+    iface_regexp: ^eth0$
+tiers:
+  - {resolution: 500ms, retention: 1h}
+  - {resolution: 1m, retention: 168h}
+billing:
+  anchor_day: 15
+accounting:
+  monthly_quota: 50GB
+link_speeds:
+  veth0: 10G
+`))
+	require.NoError(t, err)
+
+	s := Settings{
+		IfaceRegexp: regexp.MustCompile(`.*`),
+		Metrics: metrics.Config{
+			Interval:      time.Second,
+			BurstWindows:  []time.Duration{time.Second},
+			OutputWindows: []time.Duration{15 * time.Second},
+			Breakdown:     metrics.BreakdownIface,
+			LegacyNames:   true,
+		},
+	}
+	require.NoError(t, f.Apply(&s))
+
+	assert.Equal(t, IfaceModeDefaultRoute, s.IfaceMode)
+	assert.Equal(t, `^eth\d+$`, s.IfaceRegexp.String())
+	assert.Equal(t, netdev.AggregateTopLevel, s.Aggregation)
+	assert.True(t, s.AllNetns)
+	assert.True(t, s.VethPeers)
+	require.NotNil(t, s.Containers)
+	assert.Equal(t, []string{"/run/containerd/io.containerd.runtime.v2.task/k8s.io"}, s.Containers.BundleDirs)
+	c := s.Metrics
+	assert.Equal(t, 500*time.Millisecond, c.Interval)
+	assert.Equal(t, []time.Duration{time.Second}, c.BurstWindows)
+	assert.Equal(t, []time.Duration{15 * time.Second}, c.OutputWindows)
+	assert.Equal(t, metrics.BreakdownIface, c.Breakdown)
+	assert.False(t, c.LegacyNames)
+	assert.Equal(t, []float64{0.5, 0.99}, c.Quantiles)
+	assert.Equal(t, []metrics.Burst{
+		{
+			Counters:      []netdev.Counter{netdev.RecvBytes, netdev.TrnsBytes},
+			BurstWindows:  []time.Duration{time.Second},
+			OutputWindows: []time.Duration{time.Minute},
+		},
+		{
+			Counters:      []netdev.Counter{netdev.RecvPackets, netdev.TrnsPackets, netdev.RecvDrop},
+			BurstWindows:  []time.Duration{5 * time.Minute},
+			OutputWindows: []time.Duration{time.Hour, 24 * time.Hour},
+		},
+	}, c.Bursts)
+	assert.Equal(t, []series.Tier{
+		{Resolution: 500 * time.Millisecond, Retention: time.Hour},
+		{Resolution: time.Minute, Retention: 168 * time.Hour},
+	}, c.Tiers)
+	require.NotNil(t, c.Billing)
+	assert.Equal(t, 15, c.Billing.AnchorDay)
+	assert.Equal(t, billing.DefaultPercentile, c.Billing.Percentile)
+	assert.Equal(t, map[string]int64{"veth0": 10e9}, c.LinkSpeeds)
+	require.NotNil(t, c.Accounting)
+	assert.Equal(t, 1, c.Accounting.MonthStartDay)
+	assert.Equal(t, int64(50e9), c.Accounting.MonthlyQuota)
+	require.Len(t, c.Groups, 1)
+	assert.Equal(t, "uplink", c.Groups[0].Name)
+	assert.Equal(t, `^eth0$`, c.Groups[0].Ifaces.String())
+}
+
+func TestApply_Errors(t *testing.T) {
+	for _, s := range []string{
+		"bogus: 1",
+		"interval: 1x",
+		"iface_regexp: '('",
+		"iface_mode: bogus",
+		"aggregation: bottom",
+		"source: sysfs",
+		"{source: netlink, all_netns: true}",
+		"containers: {}",
+		"breakdown: bogus",
+		"burst_windows: [1500ms]",
+		"quantiles: [1.5]",
+		"bursts: [{counters: [bogus], burst_windows: [1s], output_windows: [1m]}]",
+		"bursts: [{burst_windows: [1s]}]",
+		"groups: [{name: uplink}]",
+		"groups: [{name: a, iface_regexp: x}, {name: a, iface_regexp: y}]",
+		"tiers: [{resolution: 2s, retention: 1h}]",
+		"tiers: [{resolution: 1s, retention: 30s}]",
+		"billing: {anchor_day: 31}",
+		"billing: {percentile: 95}",
+		"accounting: {monthly_quota: lots}",
+		"link_speeds: {veth0: fast}",
+		"accounting: {month_start_day: 31}",
+	} {
+		f, err := Parse([]byte(s))
+		if err == nil {
+			err = f.Apply(&Settings{
+				Metrics: metrics.Config{
+					Interval:      time.Second,
+					BurstWindows:  []time.Duration{time.Second},
+					OutputWindows: []time.Duration{time.Minute},
+				},
+			})
+		}
+		if err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestParse_Empty(t *testing.T) {
+	f, err := Parse(nil)
+	require.NoError(t, err)
+	assert.Equal(t, &File{}, f)
+}
+
+func TestApply_Source(t *testing.T) {
+	f, err := Parse([]byte("source: netlink\n"))
+	require.NoError(t, err)
+	s := Settings{
+		Metrics: metrics.Config{
+			Interval:      time.Second,
+			BurstWindows:  []time.Duration{time.Second},
+			OutputWindows: []time.Duration{time.Minute},
+		},
+	}
+	require.NoError(t, f.Apply(&s))
+	assert.Equal(t, netdev.BackendNetlink, s.Source)
+}
+
+func TestApply_Containers(t *testing.T) {
+	f, err := Parse([]byte("{veth_peers: true, containers: {}}\n"))
+	require.NoError(t, err)
+	s := Settings{
+		Containers: &Containers{BundleDirs: []string{"/run/k3s/containerd/io.containerd.runtime.v2.task/k8s.io"}},
+		Metrics: metrics.Config{
+			Interval:      time.Second,
+			BurstWindows:  []time.Duration{time.Second},
+			OutputWindows: []time.Duration{time.Minute},
+		},
+	}
+	require.NoError(t, f.Apply(&s))
+	assert.Equal(t, []string{"/run/k3s/containerd/io.containerd.runtime.v2.task/k8s.io"}, s.Containers.BundleDirs)
+}
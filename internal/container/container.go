@@ -0,0 +1,223 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+// Package container identifies the container that a process runs in,
+// and the Kubernetes pod that the container belongs to,
+// from the cgroups of the process and the OCI bundle of the container.
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Identity identifies a container and the pod it belongs to.
+// Fields that aren't known are empty.
+type Identity struct {
+	ContainerID string // Full ID, e.g. 64 hexadecimal digits for Docker, containerd and CRI-O.
+	PodUID      string
+	Pod         string // Name of the pod, only known from the bundle of the container.
+	Namespace   string // Kubernetes namespace of the pod, only known from the bundle of the container.
+}
+
+// IsZero reports whether nothing is known about the container.
+func (id Identity) IsZero() bool {
+	return id == Identity{}
+}
+
+// DefaultBundleDirs are the directories where containerd and CRI-O
+// keep the OCI bundles of the containers of Kubernetes.
+var DefaultBundleDirs = []string{
+	"/run/containerd/io.containerd.runtime.v2.task/k8s.io",
+	"/run/containers/storage/overlay-containers",
+}
+
+// Resolver finds the identity of the container of a process.
+type Resolver struct {
+	procDir    string
+	bundleDirs []string
+}
+
+// NewResolver returns a Resolver that reads the cgroups of processes from
+// the procfs mounted on procDir, and the name and namespace of pods from the
+// annotations of the OCI bundles of their containers, in bundleDirs
+// (DefaultBundleDirs if empty) of the root of the host.
+// The root of the host is the one of its init process in procDir,
+// so that the bundles can be read from a container with the host's /proc.
+// A bundle is the config.json, or userdata/config.json for CRI-O,
+// in the directory named after the container ID.
+func NewResolver(procDir string, bundleDirs []string) *Resolver {
+	if len(bundleDirs) == 0 {
+		bundleDirs = DefaultBundleDirs
+	}
+	return &Resolver{
+		procDir:    procDir,
+		bundleDirs: bundleDirs,
+	}
+}
+
+// Resolve returns the identity of the container that the process pid runs in,
+// which is zero for a process that doesn't run in a container.
+// A missing bundle leaves the name and namespace of the pod unknown.
+func (r *Resolver) Resolve(pid int) (Identity, error) {
+	b, err := os.ReadFile(filepath.Join(r.procDir, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return Identity{}, fmt.Errorf("could not read cgroups: %w", err)
+	}
+	id := ParseCgroup(b)
+	if id.ContainerID == "" {
+		return id, nil
+	}
+	err = r.readBundle(&id)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return id, err
+	}
+	return id, nil
+}
+
+// Annotations of the pod of a container, set by containerd and CRI-O respectively
+// on every container of the pod.
+const (
+	containerdPodName      = "io.kubernetes.cri.sandbox-name"
+	containerdPodNamespace = "io.kubernetes.cri.sandbox-namespace"
+	crioPodName            = "io.kubernetes.pod.name"
+	crioPodNamespace       = "io.kubernetes.pod.namespace"
+)
+
+// bundle is the part of the config.json of an OCI bundle that identifies its pod.
+type bundle struct {
+	Annotations map[string]string `json:"annotations"`
+}
+
+// readBundle sets the pod name and namespace of id
+// from the annotations of the OCI bundle of its container.
+func (r *Resolver) readBundle(id *Identity) error {
+	root := filepath.Join(r.procDir, "1", "root")
+	for _, dir := range r.bundleDirs {
+		for _, name := range []string{"config.json", "userdata/config.json"} {
+			b, err := os.ReadFile(filepath.Join(root, dir, id.ContainerID, name))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("could not read bundle: %w", err)
+			}
+			return parseBundle(id, b)
+		}
+	}
+	return fmt.Errorf("could not find bundle of %q: %w", id.ContainerID, fs.ErrNotExist)
+}
+
+// parseBundle sets the pod name and namespace of id from the config.json b.
+func parseBundle(id *Identity, b []byte) error {
+	var c bundle
+	err := json.Unmarshal(b, &c)
+	if err != nil {
+		return fmt.Errorf("could not parse bundle of %q: %w", id.ContainerID, err)
+	}
+	id.Pod = c.Annotations[containerdPodName]
+	id.Namespace = c.Annotations[containerdPodNamespace]
+	if id.Pod == "" {
+		id.Pod = c.Annotations[crioPodName]
+		id.Namespace = c.Annotations[crioPodNamespace]
+	}
+	return nil
+}
+
+// ParseCgroup finds the container ID and pod UID in the content of /proc/<pid>/cgroup,
+// whose lines look like, with cgroup v1 and v2, and the cgroupfs and systemd drivers:
+//
+//	12:memory:/docker/<id>
+//	11:cpu,cpuacct:/kubepods/burstable/pod<uid>/<id>
+//	0::/system.slice/docker-<id>.scope
+//	0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid with underscores>.slice/cri-containerd-<id>.scope
+func ParseCgroup(b []byte) Identity {
+	var id Identity
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		_, path, ok := cutCgroupPath(scanner.Text())
+		if !ok {
+			continue
+		}
+		for seg := range strings.SplitSeq(path, "/") {
+			seg = strings.TrimSuffix(strings.TrimSuffix(seg, ".scope"), ".slice")
+			if c := containerID(seg); c != "" && id.ContainerID == "" {
+				id.ContainerID = c
+			}
+			if u := podUID(seg); u != "" && id.PodUID == "" {
+				id.PodUID = u
+			}
+		}
+	}
+	return id
+}
+
+// cutCgroupPath returns the controllers and path of a line of /proc/<pid>/cgroup.
+func cutCgroupPath(line string) (controllers, path string, ok bool) {
+	_, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, ":")
+}
+
+// Prefixes of the container scopes of the systemd cgroup driver.
+var scopePrefixes = []string{"docker-", "cri-containerd-", "crio-", "libpod-"}
+
+// containerID returns the container ID in a segment of a cgroup path, or "" if there is none.
+func containerID(seg string) string {
+	for _, p := range scopePrefixes {
+		if s, ok := strings.CutPrefix(seg, p); ok {
+			seg = s
+			break
+		}
+	}
+	if len(seg) != 64 || !isHex(seg) {
+		return ""
+	}
+	return seg
+}
+
+// podUID returns the pod UID in a segment of a cgroup path, or "" if there is none.
+func podUID(seg string) string {
+	i := strings.LastIndex(seg, "pod")
+	if i < 0 || (i > 0 && seg[i-1] != '-') {
+		return ""
+	}
+	uid := strings.ReplaceAll(seg[i+len("pod"):], "_", "-")
+	if !isUUID(uid) {
+		return ""
+	}
+	return uid
+}
+
+func isHex(s string) bool {
+	for i := range len(s) {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isUUID reports whether s looks like 01234567-89ab-cdef-0123-456789abcdef.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for _, i := range []int{8, 13, 18, 23} {
+		if s[i] != '-' {
+			return false
+		}
+	}
+	return isHex(strings.ReplaceAll(s, "-", ""))
+}
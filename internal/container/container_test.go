@@ -0,0 +1,165 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	sandboxID  = "4f3c2b1a0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d4c3b"
+	appID      = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	otherID    = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	testPodUID = "1a2b3c4d-5e6f-7a8b-9c0d-1e2f3a4b5c6d"
+)
+
+func TestParseCgroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		cgroup string
+		want   Identity
+	}{
+		{"host", "0::/init.scope\n", Identity{}},
+		{"user session", "0::/user.slice/user-1000.slice/session-2.scope\n", Identity{}},
+		{
+			"docker v1",
+			"12:memory:/docker/" + appID + "\n" +
+				"11:cpu,cpuacct:/docker/" + appID + "\n" +
+				"0::/system.slice/containerd.service\n",
+			Identity{ContainerID: appID},
+		},
+		{
+			"docker v2 systemd",
+			"0::/system.slice/docker-" + appID + ".scope\n",
+			Identity{ContainerID: appID},
+		},
+		{
+			"kubernetes v1",
+			"11:cpu,cpuacct:/kubepods/burstable/pod" + testPodUID + "/" + appID + "\n",
+			Identity{ContainerID: appID, PodUID: testPodUID},
+		},
+		{
+			"kubernetes v2 systemd",
+			"0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1a2b3c4d_5e6f_7a8b_9c0d_1e2f3a4b5c6d.slice/cri-containerd-" + appID + ".scope\n",
+			Identity{ContainerID: appID, PodUID: testPodUID},
+		},
+		{
+			"cri-o",
+			"0::/kubepods.slice/kubepods-pod1a2b3c4d_5e6f_7a8b_9c0d_1e2f3a4b5c6d.slice/crio-" + appID + ".scope\n",
+			Identity{ContainerID: appID, PodUID: testPodUID},
+		},
+		{"garbage", "nonsense\n\n0::/docker/abc\n", Identity{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ParseCgroup([]byte(tt.cgroup)))
+		})
+	}
+}
+
+// fakeResolver returns a Resolver of a procfs where each pid has the given cgroup,
+// and of a host root with the containerd bundle of sandboxID
+// and the CRI-O bundle of appID.
+func fakeResolver(t *testing.T, cgroups map[int]string) *Resolver {
+	t.Helper()
+	procDir := t.TempDir()
+	for pid, cgroup := range cgroups {
+		dir := filepath.Join(procDir, strconv.Itoa(pid))
+		require.NoError(t, os.Mkdir(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0o644))
+	}
+	writeBundle(t, filepath.Join(procDir, "1/root", DefaultBundleDirs[0], sandboxID, "config.json"), `{
+		"ociVersion": "1.1.0",
+		"annotations": {
+			"io.kubernetes.cri.container-type": "sandbox",
+			"io.kubernetes.cri.sandbox-id": "`+sandboxID+`",
+			"io.kubernetes.cri.sandbox-name": "nginx-7c5ddbdf54-x8kq2",
+			"io.kubernetes.cri.sandbox-namespace": "web",
+			"io.kubernetes.cri.sandbox-uid": "`+testPodUID+`"
+		}
+	}`)
+	writeBundle(t, filepath.Join(procDir, "1/root", DefaultBundleDirs[1], appID, "userdata/config.json"), `{
+		"ociVersion": "1.0.2-dev",
+		"annotations": {
+			"io.kubernetes.container.name": "redis",
+			"io.kubernetes.pod.name": "redis-0",
+			"io.kubernetes.pod.namespace": "cache",
+			"io.kubernetes.pod.uid": "`+testPodUID+`"
+		}
+	}`)
+	return NewResolver(procDir, nil)
+}
+
+func writeBundle(t *testing.T, path, config string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(config), 0o644))
+}
+
+func TestResolver(t *testing.T) {
+	r := fakeResolver(t, map[int]string{
+		1:   "0::/init.scope\n",
+		100: "0::/kubepods.slice/kubepods-pod1a2b3c4d_5e6f_7a8b_9c0d_1e2f3a4b5c6d.slice/cri-containerd-" + sandboxID + ".scope\n",
+		200: "0::/kubepods.slice/kubepods-pod1a2b3c4d_5e6f_7a8b_9c0d_1e2f3a4b5c6d.slice/crio-" + appID + ".scope\n",
+		300: "0::/kubepods.slice/kubepods-pod1a2b3c4d_5e6f_7a8b_9c0d_1e2f3a4b5c6d.slice/cri-containerd-" + otherID + ".scope\n",
+	})
+
+	id, err := r.Resolve(1)
+	require.NoError(t, err)
+	assert.True(t, id.IsZero())
+
+	// containerd.
+	id, err = r.Resolve(100)
+	require.NoError(t, err)
+	assert.Equal(t, Identity{
+		ContainerID: sandboxID,
+		PodUID:      testPodUID,
+		Pod:         "nginx-7c5ddbdf54-x8kq2",
+		Namespace:   "web",
+	}, id)
+
+	// CRI-O.
+	id, err = r.Resolve(200)
+	require.NoError(t, err)
+	assert.Equal(t, Identity{
+		ContainerID: appID,
+		PodUID:      testPodUID,
+		Pod:         "redis-0",
+		Namespace:   "cache",
+	}, id)
+
+	// Without a bundle, pods are only known by their UID.
+	id, err = r.Resolve(300)
+	require.NoError(t, err)
+	assert.Equal(t, Identity{ContainerID: otherID, PodUID: testPodUID}, id)
+
+	_, err = r.Resolve(400)
+	assert.Error(t, err)
+}
+
+func TestResolver_BundleDirs(t *testing.T) {
+	r := fakeResolver(t, map[int]string{
+		100: "0::/kubepods.slice/kubepods-pod1a2b3c4d_5e6f_7a8b_9c0d_1e2f3a4b5c6d.slice/cri-containerd-" + sandboxID + ".scope\n",
+	})
+	r = NewResolver(r.procDir, []string{"/var/run/other"})
+	id, err := r.Resolve(100)
+	require.NoError(t, err)
+	assert.Equal(t, Identity{ContainerID: sandboxID, PodUID: testPodUID}, id)
+}
+
+func TestResolver_BadBundle(t *testing.T) {
+	r := fakeResolver(t, map[int]string{
+		100: "0::/system.slice/docker-" + otherID + ".scope\n",
+	})
+	writeBundle(t, filepath.Join(r.procDir, "1/root", DefaultBundleDirs[0], otherID, "config.json"), "{")
+	id, err := r.Resolve(100)
+	assert.Error(t, err)
+	assert.Equal(t, otherID, id.ContainerID)
+}
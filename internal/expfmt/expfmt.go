@@ -0,0 +1,175 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+// Package expfmt writes metrics in the Prometheus text
+// and OpenMetrics text exposition formats.
+package expfmt
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatOpenMetrics
+
+	NumFormats
+)
+
+// ContentType returns the Content-Type header of f.
+func (f Format) ContentType() string {
+	if f == FormatOpenMetrics {
+		return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	}
+	return "text/plain; version=0.0.4; charset=utf-8"
+}
+
+// Negotiate returns the format preferred by an Accept header.
+// It prefers the Prometheus text format when the header doesn't ask for OpenMetrics,
+// or gives it no higher a quality than text/plain.
+func Negotiate(accept string) Format {
+	var textQ, openMetricsQ float64
+	for item := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(item)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/openmetrics-text":
+			openMetricsQ = max(openMetricsQ, q)
+		case "text/plain", "text/*", "*/*":
+			textQ = max(textQ, q)
+		}
+	}
+	if openMetricsQ > textQ {
+		return FormatOpenMetrics
+	}
+	return FormatText
+}
+
+type Type string
+
+const (
+	Counter Type = "counter"
+	Gauge   Type = "gauge"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Writer appends metrics to a buffer.
+// A family's metadata lines are only written by Family,
+// so metrics written without a preceding call to Family have none,
+// which is how netexp's legacy metrics are written.
+type Writer struct {
+	b      []byte
+	format Format
+}
+
+// Reset makes the writer append to b in the given format.
+func (w *Writer) Reset(b []byte, f Format) {
+	w.b = b
+	w.format = f
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.b
+}
+
+// Family writes the HELP, TYPE and, in OpenMetrics, UNIT lines of a metric family.
+// name is the name of the samples, including the _total suffix of counters.
+// unit may be empty, and otherwise must be a suffix of the family name.
+// All samples of the family must follow before the next call to Family.
+func (w *Writer) Family(name string, typ Type, unit, help string) {
+	om := w.format == FormatOpenMetrics
+	if om && typ == Counter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	w.b = append(w.b, "# HELP "...)
+	w.b = append(w.b, name...)
+	w.b = append(w.b, ' ')
+	w.b = appendEscaped(w.b, help, om)
+	w.b = append(w.b, '\n')
+	w.b = append(w.b, "# TYPE "...)
+	w.b = append(w.b, name...)
+	w.b = append(w.b, ' ')
+	w.b = append(w.b, typ...)
+	w.b = append(w.b, '\n')
+	if om && unit != "" {
+		w.b = append(w.b, "# UNIT "...)
+		w.b = append(w.b, name...)
+		w.b = append(w.b, ' ')
+		w.b = append(w.b, unit...)
+		w.b = append(w.b, '\n')
+	}
+}
+
+// End finishes the exposition, which in OpenMetrics is marked with an EOF line.
+func (w *Writer) End() {
+	if w.format == FormatOpenMetrics {
+		w.b = append(w.b, "# EOF\n"...)
+	}
+}
+
+// Int writes a sample with an integer value.
+func (w *Writer) Int(name string, labels []Label, v int64) {
+	w.appendName(name, labels)
+	w.b = strconv.AppendInt(w.b, v, 10)
+	w.b = append(w.b, '\n')
+}
+
+// Float writes a sample with a floating-point value.
+func (w *Writer) Float(name string, labels []Label, v float64) {
+	w.appendName(name, labels)
+	w.b = strconv.AppendFloat(w.b, v, 'f', -1, 64)
+	w.b = append(w.b, '\n')
+}
+
+func (w *Writer) appendName(name string, labels []Label) {
+	w.b = append(w.b, name...)
+	if len(labels) > 0 {
+		w.b = append(w.b, '{')
+		for i, l := range labels {
+			if i > 0 {
+				w.b = append(w.b, ',')
+			}
+			w.b = append(w.b, l.Name...)
+			w.b = append(w.b, `="`...)
+			w.b = appendEscaped(w.b, l.Value, true)
+			w.b = append(w.b, '"')
+		}
+		w.b = append(w.b, '}')
+	}
+	w.b = append(w.b, ' ')
+}
+
+// appendEscaped escapes backslashes and newlines, and optionally double quotes,
+// as described by the exposition formats.
+func appendEscaped(b []byte, s string, quote bool) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			b = append(b, `\\`...)
+		case c == '\n':
+			b = append(b, `\n`...)
+		case c == '"' && quote:
+			b = append(b, `\"`...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package expfmt_test
+
+import (
+	"testing"
+
+	"github.com/layer8co/netexp/internal/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	var w expfmt.Writer
+	w.Reset(nil, expfmt.FormatText)
+	w.Int("legacy_metric", nil, 1)
+	w.Family("netexp_bytes_total", expfmt.Counter, "bytes", `Number of bytes \ "quoted".`)
+	w.Int("netexp_bytes_total", []expfmt.Label{{"direction", "recv"}}, 10)
+	w.Int("netexp_bytes_total", []expfmt.Label{{"iface", "a\"b\\c\nd"}, {"direction", "trns"}}, -5)
+	w.Family("netexp_rate", expfmt.Gauge, "", "Line\nbreak.")
+	w.Float("netexp_rate", nil, 0.25)
+	w.End()
+	want := `legacy_metric 1
+# HELP netexp_bytes_total Number of bytes \\ "quoted".
+# TYPE netexp_bytes_total counter
+netexp_bytes_total{direction="recv"} 10
+netexp_bytes_total{iface="a\"b\\c\nd",direction="trns"} -5
+# HELP netexp_rate Line\nbreak.
+# TYPE netexp_rate gauge
+netexp_rate 0.25
+`
+	assert.Equal(t, want, string(w.Bytes()))
+}
+
+func TestWriter_OpenMetrics(t *testing.T) {
+	var w expfmt.Writer
+	w.Reset([]byte("prefix\n"), expfmt.FormatOpenMetrics)
+	w.Family("netexp_bytes_total", expfmt.Counter, "bytes", `Number of bytes \ "quoted".`)
+	w.Int("netexp_bytes_total", []expfmt.Label{{"direction", "recv"}}, 10)
+	w.Family("netexp_rate", expfmt.Gauge, "", "Rate.")
+	w.Float("netexp_rate", nil, 0.25)
+	w.End()
+	want := `prefix
+# HELP netexp_bytes Number of bytes \\ \"quoted\".
+# TYPE netexp_bytes counter
+# UNIT netexp_bytes bytes
+netexp_bytes_total{direction="recv"} 10
+# HELP netexp_rate Rate.
+# TYPE netexp_rate gauge
+netexp_rate 0.25
+# EOF
+`
+	assert.Equal(t, want, string(w.Bytes()))
+}
+
+func TestNegotiate(t *testing.T) {
+	for accept, want := range map[string]expfmt.Format{
+		"":                             expfmt.FormatText,
+		"*/*":                          expfmt.FormatText,
+		"text/plain":                   expfmt.FormatText,
+		"application/openmetrics-text": expfmt.FormatOpenMetrics,
+		"application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1": expfmt.FormatOpenMetrics,
+		"text/plain;version=0.0.4;q=1,application/openmetrics-text;q=0.5":                                                                       expfmt.FormatText,
+		"application/json": expfmt.FormatText,
+	} {
+		assert.Equal(t, want, expfmt.Negotiate(accept), "%q", accept)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/netdev"
+)
+
+// DefaultMonthStartDay is the default of Accounting.MonthStartDay.
+const DefaultMonthStartDay = 1
+
+// Accounting configures the totals of bytes received and transmitted
+// in the current day and month, like vnstat's.
+type Accounting struct {
+	// MonthStartDay is the day of the month that months start on,
+	// from 1 to billing.MaxAnchorDay.
+	MonthStartDay int
+
+	// MonthlyQuota is the number of bytes that may be received and transmitted
+	// (together) in a month, or 0 for no quota.
+	MonthlyQuota int64
+
+	// Location is the time zone of the start of days and months.
+	// nil means UTC.
+	Location *time.Location
+}
+
+// Validate reports whether a is a valid accounting configuration.
+func (a *Accounting) Validate() error {
+	var errs []error
+	if !billing.ValidAnchorDay(a.MonthStartDay) {
+		errs = append(errs, fmt.Errorf("month start day %d is not between 1 and %d", a.MonthStartDay, billing.MaxAnchorDay))
+	}
+	if a.MonthlyQuota < 0 {
+		errs = append(errs, fmt.Errorf("monthly quota %d is negative", a.MonthlyQuota))
+	}
+	return errors.Join(errs...)
+}
+
+func (a *Accounting) location() *time.Location {
+	if a.Location == nil {
+		return time.UTC
+	}
+	return a.Location
+}
+
+// dayStart returns the start of the day that t is in.
+func (a *Accounting) dayStart(t time.Time) time.Time {
+	loc := a.location()
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// monthStart returns the start of the month that t is in.
+func (a *Accounting) monthStart(t time.Time) time.Time {
+	return billing.PeriodStart(t, a.MonthStartDay, a.location())
+}
+
+// PeriodTotals are the bytes received and transmitted in the current day and month.
+type PeriodTotals struct {
+	Day   [2]int64 `json:"day"`   // Received and transmitted.
+	Month [2]int64 `json:"month"` // Received and transmitted.
+}
+
+// add adds the increase inc of counter c to p.
+func (p *PeriodTotals) add(c netdev.Counter, inc int64) {
+	i := 0
+	switch c {
+	case netdev.RecvBytes:
+	case netdev.TrnsBytes:
+		i = 1
+	default:
+		return
+	}
+	p.Day[i] += inc
+	p.Month[i] += inc
+}
+
+// periods holds the totals of Config.Accounting.
+type periods struct {
+	day, month time.Time
+
+	// Totals of every interface seen in the current month, by ID,
+	// including the ones that disappeared,
+	// so that an interface that is re-created keeps its totals.
+	ifaces map[string]*PeriodTotals
+}
+
+// rollPeriods starts a new day or month if t is in one,
+// setting the totals of the previous one to zero.
+// Interfaces that were not seen in the previous month are forgotten.
+func (m *Metrics) rollPeriods(t time.Time) {
+	p := &m.periods
+	day := m.Accounting.dayStart(t)
+	month := m.Accounting.monthStart(t)
+	newDay := day.After(p.day)
+	newMonth := month.After(p.month)
+	if !newDay && !newMonth {
+		return
+	}
+	if newMonth {
+		maps.DeleteFunc(p.ifaces, func(id string, _ *PeriodTotals) bool {
+			return m.ifaces[keyOf(id)] == nil
+		})
+	}
+	totals := make([]*PeriodTotals, 0, 1+len(m.groups)+len(p.ifaces))
+	totals = append(totals, m.total.period)
+	for _, g := range m.groups {
+		totals = append(totals, g.period)
+	}
+	for _, pt := range p.ifaces {
+		totals = append(totals, pt)
+	}
+	for _, pt := range totals {
+		if newDay {
+			pt.Day = [2]int64{}
+		}
+		if newMonth {
+			pt.Month = [2]int64{}
+		}
+	}
+	if newDay {
+		p.day = day
+	}
+	if newMonth {
+		p.month = month
+	}
+}
+
+// ifacePeriod returns the totals of the interface with the given ID.
+func (m *Metrics) ifacePeriod(id string) *PeriodTotals {
+	pt := m.periods.ifaces[id]
+	if pt == nil {
+		pt = new(PeriodTotals)
+		m.periods.ifaces[id] = pt
+	}
+	return pt
+}
+
+// ParseBytes parses a number of bytes with an optional SI or IEC unit,
+// e.g. "500000", "50GB", or "1.5TiB".
+func ParseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+	s = strings.TrimSpace(s)
+	n := 1.0
+	number := s
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			n = u.n
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("could not parse byte size %q", s)
+	}
+	return int64(v * n), nil
+}
@@ -5,11 +5,19 @@
 package metrics
 
 import (
-	"bytes"
+	"cmp"
+	"errors"
 	"fmt"
+	"maps"
+	"regexp"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/container"
+	"github.com/layer8co/netexp/internal/expfmt"
 	"github.com/layer8co/netexp/internal/netdev"
 	"github.com/layer8co/netexp/internal/series"
 )
@@ -18,65 +26,704 @@ import (
 // provides the metric of `the maximum 5 second burst over the last 60 seconds`.
 type Metrics struct {
 	Config
-	recv      *series.TimeSeries
-	trns      *series.TimeSeries
-	recvBurst []*series.TimeSeries
-	trnsBurst []*series.TimeSeries
-	netdev    *netdev.NetDev
+	trackers []tracker
+	total    *group
+	groups   []*group // Parallel to Config.Groups.
+	ifaces   map[ifaceKey]*iface
+	billing  *billing.Billing // nil unless Config.Billing is set.
+	periods  periods          // Unused unless Config.Accounting is set.
+	started  bool
+
+	// Whether the last collection succeeded, and the time of the last one that did.
+	up       bool
+	lastStep time.Time
+
+	// Groups exported in the current step, in output order.
+	active []*group
+
+	w      expfmt.Writer
+	labels []expfmt.Label
+
+	// Label values of Config.Quantiles, and the quantiles of one series.
+	quantileLabels []string
+	quantiles      []int64
+
+	// Quantiles of each active group over one output window, for the legacy names,
+	// and whether each group has them.
+	groupQuantiles    []int64
+	hasGroupQuantiles []bool
 }
 
 type Config struct {
-	Interval      time.Duration
+	Interval time.Duration
+
+	// Burst and output windows of the byte counters.
 	BurstWindows  []time.Duration
 	OutputWindows []time.Duration
+
+	// Burst and output windows of any other counters.
+	Bursts []Burst
+
+	Breakdown Breakdown
+
+	// Quantiles of the burst rates over each output window that are exported
+	// alongside their maximum, e.g. 0.5, 0.9, and 0.99.
+	// They are only exported for output windows within the first of the Tiers.
+	Quantiles []float64
+
+	// Tiers downsample burst series, so that long output windows take bounded memory
+	// (see series.Tiered). The first tier has the interval as its resolution,
+	// and the last one has to retain the longest output window.
+	// By default, burst series are kept at full resolution for their longest output window.
+	Tiers []series.Tier
+
+	// Groups are sums of the interfaces matched by a regexp,
+	// exported with a group label regardless of the breakdown.
+	Groups []Group
+
+	// Billing, if set, samples the 5-minute average rates of the byte counters
+	// of the sum of all matched interfaces for burstable billing.
+	Billing *billing.Config
+
+	// Accounting, if set, keeps the bytes received and transmitted
+	// in the current day and month, across counter resets and restarts.
+	Accounting *Accounting
+
+	// LinkSpeeds override the link speed of interfaces by name, in bits per second,
+	// e.g. for virtual interfaces that don't report one.
+	LinkSpeeds map[string]int64
+
+	// LegacyNames makes netexp export its original metric names,
+	// which have the durations in the name, e.g. netexp_max_1s_recv_burst_bps_over_1m0s,
+	// instead of netexp_max_burst_bytes_per_second{direction="recv",burst="1s",window="1m"}.
+	LegacyNames bool
+}
+
+// Burst gives a set of counters burst and output windows,
+// e.g. `the maximum 1 second packet rate over the last 60 seconds`.
+type Burst struct {
+	Counters      []netdev.Counter
+	BurstWindows  []time.Duration
+	OutputWindows []time.Duration
+}
+
+// Group is a named sum of interfaces, e.g. all the uplinks of a host.
+type Group struct {
+	Name   string
+	Ifaces *regexp.Regexp
+}
+
+// Validate reports whether the windows and groups of c can be tracked.
+// Every window has to be a positive multiple of the interval.
+func (c *Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval %s is not positive", c.Interval)
+	}
+	var errs []error
+	validate := func(kind string, windows []time.Duration) {
+		for _, w := range windows {
+			if w <= 0 || w%c.Interval != 0 {
+				errs = append(errs, fmt.Errorf("%s window %s is not a positive multiple of the interval %s", kind, w, c.Interval))
+			}
+		}
+	}
+	validate("burst", c.BurstWindows)
+	validate("output", c.OutputWindows)
+	if len(c.BurstWindows) > 0 && len(c.OutputWindows) == 0 {
+		errs = append(errs, errors.New("burst windows are given without output windows"))
+	}
+	for _, b := range c.Bursts {
+		validate("burst", b.BurstWindows)
+		validate("output", b.OutputWindows)
+		if len(b.Counters) == 0 || len(b.BurstWindows) == 0 || len(b.OutputWindows) == 0 {
+			errs = append(errs, errors.New("bursts need at least one counter, burst window, and output window"))
+		}
+	}
+	for i, q := range c.Quantiles {
+		if !(q >= 0 && q <= 1) {
+			errs = append(errs, fmt.Errorf("quantile %g is not between 0 and 1", q))
+		} else if slices.Contains(c.Quantiles[:i], q) {
+			errs = append(errs, fmt.Errorf("quantile %g is given more than once", q))
+		}
+	}
+	if len(c.Tiers) > 0 {
+		err := series.ValidateTiers(c.Interval, c.Tiers)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid tiers: %w", err))
+		}
+		retention := c.Tiers[len(c.Tiers)-1].Retention
+		windows := slices.Clone(c.OutputWindows)
+		for _, b := range c.Bursts {
+			windows = append(windows, b.OutputWindows...)
+		}
+		for _, w := range windows {
+			if w > retention {
+				errs = append(errs, fmt.Errorf("output window %s is longer than the retention %s of the last tier", w, retention))
+			}
+		}
+	}
+	if c.Billing != nil {
+		errs = append(errs, c.Billing.Validate())
+	}
+	if c.Accounting != nil {
+		errs = append(errs, c.Accounting.Validate())
+	}
+	for name, speed := range c.LinkSpeeds {
+		if speed <= 0 {
+			errs = append(errs, fmt.Errorf("link speed %d of %q is not positive", speed, name))
+		}
+	}
+	for i, g := range c.Groups {
+		switch {
+		case g.Name == "":
+			errs = append(errs, fmt.Errorf("group %d has no name", i+1))
+		case g.Ifaces == nil:
+			errs = append(errs, fmt.Errorf("group %q has no interface regexp", g.Name))
+		case slices.ContainsFunc(c.Groups[:i], func(h Group) bool { return h.Name == g.Name }):
+			errs = append(errs, fmt.Errorf("group %q is given more than once", g.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseBurst parses a burst specification of the form
+// `counters:burst-windows:output-windows`, where each part is comma-separated,
+// e.g. `packets,recv_drop:1s,5s:1m,5m`.
+// A counter is either a full counter name such as "recv_drop",
+// or a kind such as "packets" that selects it in both directions.
+func ParseBurst(s string) (b Burst, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return b, fmt.Errorf("burst %q is not of the form counters:burst-windows:output-windows", s)
+	}
+	b.Counters, err = ParseCounters(strings.Split(parts[0], ","))
+	if err != nil {
+		return b, err
+	}
+	b.BurstWindows, err = ParseDurations(parts[1])
+	if err != nil {
+		return b, err
+	}
+	b.OutputWindows, err = ParseDurations(parts[2])
+	if err != nil {
+		return b, err
+	}
+	return b, nil
+}
+
+// ParseCounters parses counter names,
+// where a kind such as "packets" selects the counter in both directions.
+func ParseCounters(names []string) (out []netdev.Counter, err error) {
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		c, err := netdev.ParseCounter(name)
+		if err == nil {
+			out = append(out, c)
+			continue
+		}
+		n := len(out)
+		for c := range netdev.NumCounters {
+			if c.Kind() == name {
+				out = append(out, c)
+			}
+		}
+		if len(out) == n {
+			return nil, fmt.Errorf("unknown counter %q", name)
+		}
+	}
+	return out, nil
 }
 
+// ParseDurations parses a comma-separated list of durations.
+func ParseDurations(s string) (out []time.Duration, err error) {
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		d, err := time.ParseDuration(field)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse duration %q: %w", field, err)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// ParseQuantiles parses a comma-separated list of quantiles.
+// An empty string is an empty list.
+func ParseQuantiles(s string) (out []float64, err error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	for field := range strings.SplitSeq(s, ",") {
+		field = strings.TrimSpace(field)
+		q, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse quantile %q: %w", field, err)
+		}
+		out = append(out, q)
+	}
+	return out, nil
+}
+
+// ParseLinkSpeeds parses comma-separated link speeds of interfaces
+// of the form name=speed, where the speed is in bits per second
+// with an optional SI prefix, e.g. "eth0=1G,veth0=2.5G".
+// An empty string is an empty map.
+func ParseLinkSpeeds(s string) (map[string]int64, error) {
+	speeds := make(map[string]int64)
+	if strings.TrimSpace(s) == "" {
+		return speeds, nil
+	}
+	for field := range strings.SplitSeq(s, ",") {
+		name, speed, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("link speed %q is not of the form name=speed", field)
+		}
+		bps, err := ParseSpeed(speed)
+		if err != nil {
+			return nil, err
+		}
+		speeds[name] = bps
+	}
+	return speeds, nil
+}
+
+// ParseSpeed parses a link speed in bits per second
+// with an optional SI prefix, e.g. "100M" or "2.5G".
+func ParseSpeed(s string) (int64, error) {
+	prefixes := map[byte]float64{'k': 1e3, 'K': 1e3, 'M': 1e6, 'G': 1e9, 'T': 1e12}
+	s = strings.TrimSpace(s)
+	number := s
+	n := 1.0
+	if len(s) > 0 {
+		if p, ok := prefixes[s[len(s)-1]]; ok {
+			number, n = s[:len(s)-1], p
+		}
+	}
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("could not parse link speed %q", s)
+	}
+	return int64(v * n), nil
+}
+
+// Breakdown selects whether the metrics are exported
+// for the sum of all matched interfaces, for each interface, or both.
+type Breakdown int
+
+const (
+	// BreakdownTotal exports the sum of all matched interfaces, without labels.
+	BreakdownTotal Breakdown = iota
+	// BreakdownIface exports each matched interface with an iface label.
+	BreakdownIface
+	// BreakdownBoth exports both the sum and the per-interface metrics.
+	BreakdownBoth
+)
+
+var breakdownNames = []string{
+	BreakdownTotal: "total",
+	BreakdownIface: "iface",
+	BreakdownBoth:  "both",
+}
+
+func (b Breakdown) String() string {
+	if int(b) < len(breakdownNames) {
+		return breakdownNames[b]
+	}
+	return fmt.Sprintf("Breakdown(%d)", int(b))
+}
+
+func ParseBreakdown(s string) (Breakdown, error) {
+	i := slices.Index(breakdownNames, s)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown breakdown %q", s)
+	}
+	return Breakdown(i), nil
+}
+
+// tracker records the burst rate of one counter over one burst window.
+type tracker struct {
+	counter       netdev.Counter
+	burstWindow   time.Duration
+	outputWindows []time.Duration
+
+	// Label values of the burst window and of each output window,
+	// and the legacy metric name of each output window, of each quantile over it,
+	// and of the utilization of the link.
+	burstLabel             string
+	windowLabels           []string
+	legacyNames            []string
+	legacyQuantileNames    [][]string
+	legacyUtilizationNames []string
+
+	// Burst rates are kept in 1/scale units per second,
+	// so that low rates such as a few drops per second keep their fraction.
+	// Byte rates are whole bytes per second.
+	scale int64
+}
+
+const fractionScale = 1000
+
+// group holds the series of one exported label set.
+type group struct {
+	name     string // Sort key.
+	labels   []expfmt.Label
+	counters [netdev.NumCounters]*series.TimeSeries
+	bursts   []*series.Tiered // Parallel to Metrics.trackers.
+	now      netdev.Stats
+	resets   int64
+	period   *PeriodTotals // nil unless Config.Accounting is set.
+
+	// Link speed of the interface, or the sum of those of the interfaces, in bits per second.
+	// 0 if unknown, including when the speed of any of the interfaces that aren't down is unknown.
+	speed int64
+	link  *netdev.Link // Link of the interface, nil for sums.
+}
+
+// ifaceKey identifies a matched interface by its network namespace and name.
+type ifaceKey struct {
+	netns, name string
+}
+
+// keyOf returns the key of the interface with the given ID (see netdev.Iface.ID).
+func keyOf(id string) ifaceKey {
+	netns, name := netdev.SplitID(id)
+	return ifaceKey{netns, name}
+}
+
+// iface holds the state of one matched interface.
+type iface struct {
+	id        string // See netdev.Iface.ID.
+	container container.Identity
+	peer      netdev.Peer
+	prev      netdev.Stats
+	link      netdev.Link
+	group     *group   // nil unless the breakdown includes interfaces.
+	sums      []*group // The total and the groups that the interface belongs to.
+	seen      bool
+}
+
+// New returns the metrics of c, which has to be valid (see Config.Validate).
 func New(c Config) *Metrics {
 	m := &Metrics{
 		Config: c,
+		ifaces: make(map[ifaceKey]*iface),
+	}
+	for _, q := range m.Quantiles {
+		m.quantileLabels = append(m.quantileLabels, strconv.FormatFloat(q, 'g', -1, 64))
 	}
-	window := slices.Max(m.OutputWindows)
-	m.recv = series.New(m.Interval, window)
-	m.trns = series.New(m.Interval, window)
-	for range m.BurstWindows {
-		m.recvBurst = append(m.recvBurst, series.New(m.Interval, window))
-		m.trnsBurst = append(m.trnsBurst, series.New(m.Interval, window))
+	m.quantiles = make([]int64, len(m.Quantiles))
+	m.addTrackers(Burst{
+		Counters:      []netdev.Counter{netdev.RecvBytes, netdev.TrnsBytes},
+		BurstWindows:  m.BurstWindows,
+		OutputWindows: m.OutputWindows,
+	})
+	for _, b := range m.Bursts {
+		m.addTrackers(b)
+	}
+	m.total = m.newGroup("", nil)
+	for _, g := range m.Groups {
+		m.groups = append(m.groups, m.newGroup(g.Name, []expfmt.Label{{Name: "group", Value: g.Name}}))
+	}
+	if m.Billing != nil {
+		m.billing = billing.New(*m.Billing)
+	}
+	if m.Accounting != nil {
+		m.periods.ifaces = make(map[string]*PeriodTotals)
+		m.total.period = new(PeriodTotals)
+		for _, g := range m.groups {
+			g.period = new(PeriodTotals)
+		}
 	}
 	return m
 }
-func (m *Metrics) Step(recv, trns int64, b []byte) []byte {
-	m.recv.Put(recv)
-	m.trns.Put(trns)
-	b = fmt.Appendf(b, "netexp_recv_bytes %d\n", recv)
-	b = fmt.Appendf(b, "netexp_trns_bytes %d\n", trns)
-	for i, bw := range m.BurstWindows {
-		recvBurst, ok := m.recv.Rate(bw)
-		if ok {
-			m.recvBurst[i].Put(recvBurst)
+
+// addTrackers adds the trackers of b to m,
+// merging the output windows of counters and burst windows that are already tracked.
+func (m *Metrics) addTrackers(b Burst) {
+	for _, bw := range b.BurstWindows {
+		for _, c := range b.Counters {
+			i := slices.IndexFunc(m.trackers, func(t tracker) bool {
+				return t.counter == c && t.burstWindow == bw
+			})
+			if i < 0 {
+				t := tracker{
+					counter:     c,
+					burstWindow: bw,
+					burstLabel:  formatDuration(bw),
+					scale:       fractionScale,
+				}
+				if c.Kind() == "bytes" {
+					t.scale = 1
+				}
+				m.trackers = append(m.trackers, t)
+				i = len(m.trackers) - 1
+			}
+			t := &m.trackers[i]
+			for _, ow := range b.OutputWindows {
+				if !slices.Contains(t.outputWindows, ow) {
+					t.outputWindows = append(t.outputWindows, ow)
+					t.windowLabels = append(t.windowLabels, formatDuration(ow))
+					t.legacyNames = append(t.legacyNames, t.legacyName(ow))
+					var names []string
+					for _, q := range m.Quantiles {
+						names = append(names, t.legacyQuantileName(ow, q))
+					}
+					t.legacyQuantileNames = append(t.legacyQuantileNames, names)
+					t.legacyUtilizationNames = append(t.legacyUtilizationNames, t.legacyUtilizationName(ow))
+				}
+			}
 		}
-		trnsBurst, ok := m.trns.Rate(bw)
+	}
+}
+
+func (m *Metrics) newGroup(name string, labels []expfmt.Label) *group {
+	g := &group{
+		name:   name,
+		labels: labels,
+	}
+	var counterWindows [netdev.NumCounters]time.Duration
+	for _, t := range m.trackers {
+		counterWindows[t.counter] = max(counterWindows[t.counter], t.burstWindow)
+		tiers := m.Tiers
+		if len(tiers) == 0 {
+			tiers = []series.Tier{{Resolution: m.Interval, Retention: slices.Max(t.outputWindows)}}
+		}
+		burst := series.NewTiered(m.Interval, tiers...)
+		for _, ow := range t.outputWindows {
+			burst.TrackMax(ow)
+		}
+		g.bursts = append(g.bursts, burst)
+	}
+	for c, window := range counterWindows {
+		if window > 0 {
+			g.counters[c] = series.NewCounter(m.Interval, window)
+		}
+	}
+	return g
+}
+
+func (g *group) put(stats *netdev.Stats, trackers []tracker) {
+	g.now = *stats
+	for c, s := range g.counters {
+		if s != nil {
+			s.Put(stats[c])
+		}
+	}
+	for i, t := range trackers {
+		diff, ok := g.counters[t.counter].Increase(t.burstWindow)
 		if ok {
-			m.trnsBurst[i].Put(trnsBurst)
-		}
-		for _, ow := range m.OutputWindows {
-			maxRecvBurst, ok := m.recvBurst[i].Max(ow)
-			if ok {
-				b = fmt.Appendf(
-					b,
-					"netexp_max_%s_recv_burst_bps_over_%s %d\n",
-					bw, ow, maxRecvBurst,
-				)
+			rate := float64(diff*t.scale) / t.burstWindow.Seconds()
+			g.bursts[i].Put(int64(rate))
+		} else if g.bursts[i].Len() > 0 {
+			// The burst window reaches back into a gap.
+			g.bursts[i].Skip(1)
+		}
+	}
+}
+
+// Step records one sample of the given interfaces collected at time t,
+// whose metrics can then be appended with Append.
+// Interfaces that are missing from ifaces have their series dropped.
+//
+// Intervals that passed without a step since the previous one,
+// e.g. because collection was failing, are recorded as gaps in the series,
+// so that no rate is computed across them.
+//
+// The sum of all interfaces, and that of each group, is kept as a counter of its own,
+// which grows by the reset-aware increase of each interface,
+// so that interfaces that are reset, re-created, or come and go
+// do not make it decrease.
+// Interfaces that show up after the first step only add what they grow by from then on.
+func (m *Metrics) Step(t time.Time, ifaces []netdev.Iface) {
+
+	m.active = m.active[:0]
+
+	if !m.lastStep.IsZero() {
+		missed := int((t.Sub(m.lastStep)+m.Interval/2)/m.Interval) - 1
+		if missed > 0 {
+			m.skip(missed)
+		}
+	}
+	m.lastStep = t
+	m.up = true
+	if m.Accounting != nil {
+		m.rollPeriods(t)
+	}
+
+	for _, x := range m.ifaces {
+		x.seen = false
+	}
+	m.total.speed = 0
+	for _, g := range m.groups {
+		g.speed = 0
+	}
+	for i := range ifaces {
+		stats := &ifaces[i].Stats
+		name := ifaces[i].Name
+		x, ok := m.ifaces[ifaceKey{ifaces[i].Netns, name}]
+		if !ok {
+			x = m.newIface(ifaces[i].ID(), stats)
+		}
+		x.seen = true
+		if x.container != ifaces[i].Container || x.peer != ifaces[i].Peer {
+			// Restored interfaces only learn their container and peer with their first step,
+			// and veths are only paired once the namespace of their peer is found.
+			x.container = ifaces[i].Container
+			x.peer = ifaces[i].Peer
+			if x.group != nil {
+				x.group.labels = ifaceLabels(x.id, &x.container, &x.peer)
+			}
+		}
+		x.link = ifaces[i].Link
+		if speed, ok := m.LinkSpeeds[name]; ok {
+			x.link.Speed = speed
+		}
+		for _, g := range x.sums {
+			// -1 marks a sum with an interface of unknown speed until the end of the step.
+			// Interfaces that are down carry no traffic, and add nothing to the speed.
+			if x.link.Speed == 0 && !x.link.Down() {
+				g.speed = -1
+			} else if g.speed >= 0 {
+				g.speed += x.link.Speed
+			}
+		}
+		if x.group != nil {
+			x.group.speed = x.link.Speed
+		}
+		reset := false
+		for c := range stats {
+			inc, r := series.CounterIncrease(x.prev[c], stats[c])
+			for _, g := range x.sums {
+				g.now[c] += inc
+				if g.period != nil {
+					g.period.add(netdev.Counter(c), inc)
+				}
+			}
+			if x.group != nil && x.group.period != nil {
+				x.group.period.add(netdev.Counter(c), inc)
+			}
+			reset = reset || r
+		}
+		x.prev = *stats
+		if reset {
+			for _, g := range x.sums {
+				g.resets++
+			}
+			if x.group != nil {
+				x.group.resets++
 			}
-			maxTransBurst, ok := m.trnsBurst[i].Max(ow)
-			if ok {
-				b = fmt.Appendf(
-					b,
-					"netexp_max_%s_trns_burst_bps_over_%s %d\n",
-					bw, ow, maxTransBurst,
-				)
+		}
+		if x.group != nil {
+			x.group.put(stats, m.trackers)
+		}
+	}
+	maps.DeleteFunc(m.ifaces, func(_ ifaceKey, x *iface) bool {
+		return !x.seen
+	})
+	m.started = true
+
+	m.total.speed = max(m.total.speed, 0)
+	for _, g := range m.groups {
+		g.speed = max(g.speed, 0)
+	}
+
+	if m.billing != nil {
+		m.billing.Step(t, m.total.now[netdev.RecvBytes], m.total.now[netdev.TrnsBytes])
+	}
+
+	if m.Breakdown != BreakdownIface {
+		m.total.put(&m.total.now, m.trackers)
+		m.active = append(m.active, m.total)
+	}
+
+	for _, g := range m.groups {
+		g.put(&g.now, m.trackers)
+		m.active = append(m.active, g)
+	}
+
+	if m.Breakdown != BreakdownTotal {
+		n := len(m.active)
+		for _, x := range m.ifaces {
+			m.active = append(m.active, x.group)
+		}
+		slices.SortFunc(m.active[n:], func(a, b *group) int {
+			return strings.Compare(a.name, b.name)
+		})
+	}
+}
+
+// ifaceLabels returns the labels of the interface with the given ID.
+// The interfaces of a network namespace are exported with a netns label,
+// those paired with a peer with the labels of the peer,
+// and those of a container with the labels of its identity that are known.
+func ifaceLabels(id string, c *container.Identity, peer *netdev.Peer) []expfmt.Label {
+	netns, name := netdev.SplitID(id)
+	labels := []expfmt.Label{{Name: "iface", Value: name}}
+	for _, l := range []expfmt.Label{
+		{Name: "netns", Value: netns},
+		{Name: "peer_iface", Value: peer.Name},
+		{Name: "peer_netns", Value: peer.Netns},
+		{Name: "container_id", Value: c.ContainerID},
+		{Name: "pod", Value: cmp.Or(c.Pod, c.PodUID)},
+		{Name: "namespace", Value: c.Namespace},
+	} {
+		if l.Value != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// newIface starts tracking a newly matched interface with the given ID.
+func (m *Metrics) newIface(id string, stats *netdev.Stats) *iface {
+	key := keyOf(id)
+	name := key.name
+	x := &iface{id: id, prev: *stats}
+	x.sums = append(x.sums, m.total)
+	for i, g := range m.Groups {
+		if g.Ifaces.MatchString(name) {
+			x.sums = append(x.sums, m.groups[i])
+		}
+	}
+	if !m.started {
+		for _, g := range x.sums {
+			g.now.Add(stats)
+		}
+	}
+	if m.Breakdown != BreakdownTotal {
+		x.group = m.newGroup(id, ifaceLabels(id, &x.container, &x.peer))
+		x.group.link = &x.link
+		if m.Accounting != nil {
+			x.group.period = m.ifacePeriod(id)
+		}
+	}
+	m.ifaces[key] = x
+	return x
+}
+
+// Fail records a failed collection.
+// Until the next Step, Append only exports netexp_up
+// and the time of the last successful collection,
+// so that the other metrics go stale instead of being repeated.
+func (m *Metrics) Fail() {
+	m.up = false
+}
+
+func (m *Metrics) skip(n int) {
+	groups := append([]*group{m.total}, m.groups...)
+	for _, x := range m.ifaces {
+		if x.group != nil {
+			groups = append(groups, x.group)
+		}
+	}
+	for _, g := range groups {
+		for _, s := range g.counters {
+			if s != nil {
+				s.Skip(n)
 			}
 		}
+		for _, s := range g.bursts {
+			s.Skip(n)
+		}
 	}
-	b = bytes.TrimRight(b, "\n")
-	return b
 }
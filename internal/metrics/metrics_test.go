@@ -6,6 +6,7 @@ package metrics_test
 import (
 	"bytes"
 	"fmt"
+	"regexp"
 	"runtime"
 	"slices"
 	"strings"
@@ -14,11 +15,16 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/container"
+	"github.com/layer8co/netexp/internal/expfmt"
 	"github.com/layer8co/netexp/internal/metrics"
+	"github.com/layer8co/netexp/internal/netdev"
+	"github.com/layer8co/netexp/internal/series"
 )
 
 func TestMetrics(t *testing.T) {
-	m := metrics.New(metrics.Config{
+	m := newTester(metrics.Config{
 		Interval: time.Second,
 		BurstWindows: []time.Duration{
 			1 * time.Second,
@@ -28,6 +34,7 @@ func TestMetrics(t *testing.T) {
 			5 * time.Second,
 			10 * time.Second,
 		},
+		LegacyNames: true,
 	})
 	steps := []struct {
 		line      int
@@ -96,9 +103,9 @@ func TestMetrics(t *testing.T) {
 	}
 	for i, s := range steps {
 		t.Run(fmt.Sprintf("step%d-line%d", i, s.line), func(t *testing.T) {
-			b := m.Step(s.recv, s.trns, nil)
+			b := m.step(ifaces(s.recv, s.trns))
 			gotLines := lines(b)
-			wantLines := slices.Clone(s.wantLines)
+			wantLines := m.withDefaults(s.wantLines, "")
 			slices.Sort(gotLines)
 			slices.Sort(wantLines)
 			diff := lineDiff(wantLines, gotLines)
@@ -109,6 +116,835 @@ func TestMetrics(t *testing.T) {
 	}
 }
 
+func TestMetrics_Ifaces(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		Breakdown:     metrics.BreakdownBoth,
+		LegacyNames:   true,
+	})
+	steps := []struct {
+		line      int
+		ifaces    []netdev.Iface
+		wantLines []string
+	}{
+		{l(), []netdev.Iface{
+			iface("eth0", 10, 1),
+			iface("wlan0", 100, 2),
+		}, []string{
+			`netexp_recv_bytes 110`,
+			`netexp_trns_bytes 3`,
+			`netexp_recv_bytes{iface="eth0"} 10`,
+			`netexp_trns_bytes{iface="eth0"} 1`,
+			`netexp_recv_bytes{iface="wlan0"} 100`,
+			`netexp_trns_bytes{iface="wlan0"} 2`,
+		}},
+		{l(), []netdev.Iface{
+			iface("eth0", 20, 2),
+			iface("wlan0", 150, 4),
+		}, []string{
+			`netexp_recv_bytes 170`,
+			`netexp_trns_bytes 6`,
+			`netexp_recv_bytes{iface="eth0"} 20`,
+			`netexp_trns_bytes{iface="eth0"} 2`,
+			`netexp_recv_bytes{iface="wlan0"} 150`,
+			`netexp_trns_bytes{iface="wlan0"} 4`,
+		}},
+		{l(), []netdev.Iface{
+			iface("eth0", 40, 3),
+			iface("wlan0", 160, 6),
+		}, []string{
+			`netexp_recv_bytes 200`,
+			`netexp_trns_bytes 9`,
+			`netexp_recv_bytes{iface="eth0"} 40`,
+			`netexp_trns_bytes{iface="eth0"} 3`,
+			`netexp_recv_bytes{iface="wlan0"} 160`,
+			`netexp_trns_bytes{iface="wlan0"} 6`,
+			`netexp_max_1s_recv_burst_bps_over_2s 60`,
+			`netexp_max_1s_trns_burst_bps_over_2s 3`,
+			`netexp_max_1s_recv_burst_bps_over_2s{iface="eth0"} 20`,
+			`netexp_max_1s_trns_burst_bps_over_2s{iface="eth0"} 1`,
+			`netexp_max_1s_recv_burst_bps_over_2s{iface="wlan0"} 50`,
+			`netexp_max_1s_trns_burst_bps_over_2s{iface="wlan0"} 2`,
+		}},
+		// wlan0 disappears and eth1 shows up.
+		// The sum only grows by what eth0 grew by.
+		{l(), []netdev.Iface{
+			iface("eth0", 50, 4),
+			iface("eth1", 5, 5),
+		}, []string{
+			`netexp_recv_bytes 210`,
+			`netexp_trns_bytes 10`,
+			`netexp_recv_bytes{iface="eth0"} 50`,
+			`netexp_trns_bytes{iface="eth0"} 4`,
+			`netexp_recv_bytes{iface="eth1"} 5`,
+			`netexp_trns_bytes{iface="eth1"} 5`,
+			`netexp_max_1s_recv_burst_bps_over_2s 30`,
+			`netexp_max_1s_trns_burst_bps_over_2s 3`,
+			`netexp_max_1s_recv_burst_bps_over_2s{iface="eth0"} 20`,
+			`netexp_max_1s_trns_burst_bps_over_2s{iface="eth0"} 1`,
+		}},
+		// eth0 is reset, and eth1 grows.
+		{l(), []netdev.Iface{
+			iface("eth0", 5, 1),
+			iface("eth1", 25, 6),
+		}, []string{
+			`netexp_recv_bytes 235`,
+			`netexp_trns_bytes 12`,
+			`netexp_recv_bytes{iface="eth0"} 5`,
+			`netexp_trns_bytes{iface="eth0"} 1`,
+			`netexp_recv_bytes{iface="eth1"} 25`,
+			`netexp_trns_bytes{iface="eth1"} 6`,
+			`netexp_max_1s_recv_burst_bps_over_2s 25`,
+			`netexp_max_1s_trns_burst_bps_over_2s 2`,
+			`netexp_max_1s_recv_burst_bps_over_2s{iface="eth0"} 10`,
+			`netexp_max_1s_trns_burst_bps_over_2s{iface="eth0"} 1`,
+			`netexp_counter_resets_total 1`,
+			`netexp_counter_resets_total{iface="eth0"} 1`,
+		}},
+	}
+	for i, s := range steps {
+		t.Run(fmt.Sprintf("step%d-line%d", i, s.line), func(t *testing.T) {
+			b := m.step(s.ifaces)
+			gotLines := lines(b)
+			labels := []string{""}
+			for _, iface := range s.ifaces {
+				labels = append(labels, fmt.Sprintf(`{iface=%q}`, iface.Name))
+			}
+			wantLines := m.withDefaults(s.wantLines, labels...)
+			slices.Sort(gotLines)
+			slices.Sort(wantLines)
+			diff := lineDiff(wantLines, gotLines)
+			if diff != "" {
+				t.Errorf("incorrect result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMetrics_Netns(t *testing.T) {
+	c := metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		Breakdown:     metrics.BreakdownBoth,
+	}
+	m := newTester(c)
+	// Interfaces of the same name in different namespaces are told apart.
+	netnsIfaces := func(recv1, recv2 int64) []netdev.Iface {
+		a := iface("eth0", recv1, 0)
+		a.Netns = "4026531992"
+		b := iface("eth0", recv2, 0)
+		b.Netns = "4026532201"
+		return []netdev.Iface{a, b}
+	}
+	m.step(netnsIfaces(10, 100))
+	got := lines(m.step(netnsIfaces(20, 150)))
+	assertContains(t, got, `netexp_bytes_total{direction="recv"} 170`)
+	assertContains(t, got, `netexp_bytes_total{iface="eth0",netns="4026531992",direction="recv"} 20`)
+	assertContains(t, got, `netexp_bytes_total{iface="eth0",netns="4026532201",direction="recv"} 150`)
+
+	// They are told apart across restarts too.
+	r := newTester(c)
+	r.now = m.now
+	if err := r.Restore(m.State()); err != nil {
+		t.Fatal(err)
+	}
+	got = lines(r.step(netnsIfaces(30, 250)))
+	assertContains(t, got, `netexp_max_burst_bytes_per_second{iface="eth0",netns="4026531992",direction="recv",burst="1s",window="2s"} 10`)
+	assertContains(t, got, `netexp_max_burst_bytes_per_second{iface="eth0",netns="4026532201",direction="recv",burst="1s",window="2s"} 100`)
+}
+
+func TestMetrics_Containers(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		Breakdown:     metrics.BreakdownIface,
+	})
+	containerIface := func(c container.Identity) []netdev.Iface {
+		x := iface("eth0", 10, 0)
+		x.Netns = "4026532201"
+		x.Container = c
+		return []netdev.Iface{x}
+	}
+	got := lines(m.step(containerIface(container.Identity{ContainerID: "abc", PodUID: "1a2b"})))
+	assertContains(t, got, `netexp_bytes_total{iface="eth0",netns="4026532201",container_id="abc",pod="1a2b",direction="recv"} 10`)
+
+	// The pod is known by name once the bundle of its container is found.
+	got = lines(m.step(containerIface(container.Identity{ContainerID: "abc", PodUID: "1a2b", Pod: "nginx", Namespace: "web"})))
+	assertContains(t, got, `netexp_bytes_total{iface="eth0",netns="4026532201",container_id="abc",pod="nginx",namespace="web",direction="recv"} 10`)
+
+	// Host veths are labeled with their peer, and its container.
+	veth := iface("veth1a2b3c", 20, 0)
+	veth.Peer = netdev.Peer{Netns: "4026532201", Name: "eth0"}
+	veth.Container = container.Identity{ContainerID: "abc"}
+	got = lines(m.step([]netdev.Iface{veth}))
+	assertContains(t, got, `netexp_bytes_total{iface="veth1a2b3c",peer_iface="eth0",peer_netns="4026532201",container_id="abc",direction="recv"} 20`)
+}
+
+func TestMetrics_Counters(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		LegacyNames:   true,
+	})
+	var stats netdev.Stats
+	for c := range stats {
+		stats[c] = int64(c) + 100
+	}
+	b := m.step([]netdev.Iface{{Name: "eth0", Stats: stats}})
+	gotLines := lines(b)
+	wantLines := []string{
+		"netexp_up 1",
+		"netexp_last_collect_success_timestamp_seconds 1700000001",
+		"netexp_recv_bytes 100",
+		"netexp_recv_packets 101",
+		"netexp_recv_errs 102",
+		"netexp_recv_drop 103",
+		"netexp_recv_fifo 104",
+		"netexp_recv_frame 105",
+		"netexp_recv_compressed 106",
+		"netexp_recv_multicast 107",
+		"netexp_trns_bytes 108",
+		"netexp_trns_packets 109",
+		"netexp_trns_errs 110",
+		"netexp_trns_drop 111",
+		"netexp_trns_fifo 112",
+		"netexp_trns_colls 113",
+		"netexp_trns_carrier 114",
+		"netexp_trns_compressed 115",
+		"netexp_counter_resets_total 0",
+	}
+	diff := lineDiff(wantLines, gotLines)
+	if diff != "" {
+		t.Errorf("incorrect result (-want +got):\n%s", diff)
+	}
+}
+
+func TestMetrics_Bursts(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval: time.Second,
+		Bursts: []metrics.Burst{
+			mustBurst("packets:1s:2s"),
+			mustBurst("recv_drop:2s:2s"),
+		},
+		LegacyNames: true,
+	})
+	steps := []struct {
+		line      int
+		packets   int64
+		drop      int64
+		wantLines []string
+	}{
+		{l(), 100, 0, nil},
+		{l(), 150, 1, nil},
+		{l(), 300, 1, []string{
+			"netexp_max_1s_recv_packets_burst_per_second_over_2s 150",
+			"netexp_max_1s_trns_packets_burst_per_second_over_2s 150",
+		}},
+		{l(), 310, 4, []string{
+			"netexp_max_1s_recv_packets_burst_per_second_over_2s 150",
+			"netexp_max_1s_trns_packets_burst_per_second_over_2s 150",
+			"netexp_max_2s_recv_drop_burst_per_second_over_2s 1.5",
+		}},
+	}
+	for i, s := range steps {
+		t.Run(fmt.Sprintf("step%d-line%d", i, s.line), func(t *testing.T) {
+			stats := netdev.Stats{
+				netdev.RecvPackets: s.packets,
+				netdev.TrnsPackets: s.packets,
+				netdev.RecvDrop:    s.drop,
+			}
+			b := m.step([]netdev.Iface{{Name: "eth0", Stats: stats}})
+			var gotLines []string
+			for _, line := range lines(b) {
+				if strings.HasPrefix(line, "netexp_max_") {
+					gotLines = append(gotLines, line)
+				}
+			}
+			diff := lineDiff(s.wantLines, gotLines)
+			if diff != "" {
+				t.Errorf("incorrect result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMetrics_Names(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second, time.Minute},
+		Bursts:        []metrics.Burst{mustBurst("recv_drop:1s:2s")},
+		Breakdown:     metrics.BreakdownIface,
+	})
+	m.step([]netdev.Iface{iface("eth0", 10, 20)})
+	m.step([]netdev.Iface{iface("eth0", 15, 30)})
+	b := m.step([]netdev.Iface{iface("eth0", 25, 45)})
+	var got []string
+	for _, line := range lines(b) {
+		if strings.Contains(line, "bytes") || strings.Contains(line, "drops") || strings.Contains(line, "resets") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		`# HELP netexp_bytes_total Number of bytes received or transmitted by the matched interfaces.`,
+		`# TYPE netexp_bytes_total counter`,
+		`netexp_bytes_total{iface="eth0",direction="recv"} 25`,
+		`netexp_bytes_total{iface="eth0",direction="trns"} 45`,
+		`# HELP netexp_drops_total Number of dropped packets received or transmitted by the matched interfaces.`,
+		`# TYPE netexp_drops_total counter`,
+		`netexp_drops_total{iface="eth0",direction="recv"} 0`,
+		`netexp_drops_total{iface="eth0",direction="trns"} 0`,
+		`# HELP netexp_counter_resets_total Number of times the counters of the matched interfaces went down.`,
+		`# TYPE netexp_counter_resets_total counter`,
+		`netexp_counter_resets_total{iface="eth0"} 0`,
+		`# HELP netexp_max_burst_bytes_per_second Maximum rate of bytes received or transmitted per second over a burst window, within an output window.`,
+		`# TYPE netexp_max_burst_bytes_per_second gauge`,
+		`netexp_max_burst_bytes_per_second{iface="eth0",direction="recv",burst="1s",window="2s"} 10`,
+		`netexp_max_burst_bytes_per_second{iface="eth0",direction="trns",burst="1s",window="2s"} 15`,
+		`# HELP netexp_max_burst_drops_per_second Maximum rate of dropped packets received or transmitted per second over a burst window, within an output window.`,
+		`# TYPE netexp_max_burst_drops_per_second gauge`,
+		`netexp_max_burst_drops_per_second{iface="eth0",direction="recv",burst="1s",window="2s"} 0`,
+	}
+	if diff := lineDiff(want, got); diff != "" {
+		t.Errorf("incorrect result (-want +got):\n%s", diff)
+	}
+
+	om := lines(m.Append(nil, expfmt.FormatOpenMetrics))
+	for _, line := range []string{
+		`# TYPE netexp_bytes counter`,
+		`# UNIT netexp_bytes bytes`,
+		`netexp_bytes_total{iface="eth0",direction="recv"} 25`,
+		`# TYPE netexp_counter_resets counter`,
+		`# TYPE netexp_max_burst_bytes_per_second gauge`,
+	} {
+		if !slices.Contains(om, line) {
+			t.Errorf("OpenMetrics output is missing %q", line)
+		}
+	}
+	if om[len(om)-1] != "# EOF" {
+		t.Errorf("OpenMetrics output ends with %q, want # EOF", om[len(om)-1])
+	}
+}
+
+func TestMetrics_Groups(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		Groups: []metrics.Group{
+			{Name: "wired", Ifaces: regexp.MustCompile(`^eth`)},
+			{Name: "wireless", Ifaces: regexp.MustCompile(`^wlan`)},
+		},
+	})
+	m.step([]netdev.Iface{
+		iface("eth0", 10, 1),
+		iface("eth1", 20, 2),
+		iface("wlan0", 100, 3),
+	})
+	m.step([]netdev.Iface{
+		iface("eth0", 15, 2),
+		iface("eth1", 30, 4),
+		iface("wlan0", 150, 6),
+	})
+	b := m.step([]netdev.Iface{
+		iface("eth0", 25, 3),
+		iface("eth1", 40, 6),
+		iface("wlan0", 160, 9),
+	})
+	var got []string
+	for _, line := range lines(b) {
+		if strings.HasPrefix(line, "netexp_bytes_total") || strings.HasPrefix(line, "netexp_max_burst_bytes") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		`netexp_bytes_total{direction="recv"} 225`,
+		`netexp_bytes_total{group="wired",direction="recv"} 65`,
+		`netexp_bytes_total{group="wireless",direction="recv"} 160`,
+		`netexp_bytes_total{direction="trns"} 18`,
+		`netexp_bytes_total{group="wired",direction="trns"} 9`,
+		`netexp_bytes_total{group="wireless",direction="trns"} 9`,
+		`netexp_max_burst_bytes_per_second{direction="recv",burst="1s",window="2s"} 65`,
+		`netexp_max_burst_bytes_per_second{group="wired",direction="recv",burst="1s",window="2s"} 20`,
+		`netexp_max_burst_bytes_per_second{group="wireless",direction="recv",burst="1s",window="2s"} 50`,
+		`netexp_max_burst_bytes_per_second{direction="trns",burst="1s",window="2s"} 6`,
+		`netexp_max_burst_bytes_per_second{group="wired",direction="trns",burst="1s",window="2s"} 3`,
+		`netexp_max_burst_bytes_per_second{group="wireless",direction="trns",burst="1s",window="2s"} 3`,
+	}
+	if diff := lineDiff(want, got); diff != "" {
+		t.Errorf("incorrect result (-want +got):\n%s", diff)
+	}
+}
+
+func TestMetrics_Tiers(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second, time.Minute},
+		Tiers: []series.Tier{
+			{Resolution: time.Second, Retention: 10 * time.Second},
+			{Resolution: 5 * time.Second, Retention: time.Minute},
+		},
+	})
+	v := int64(0)
+	for i := range 70 {
+		if i == 20 {
+			v += 1000 // A burst that is only in the coarser tier by the end.
+		}
+		v += 10
+		m.step(ifaces(v, v))
+	}
+	b := m.step(ifaces(v+10, v+10))
+	got := lines(b)
+	assertContains(t, got, `netexp_max_burst_bytes_per_second{direction="recv",burst="1s",window="2s"} 10`)
+	assertContains(t, got, `netexp_max_burst_bytes_per_second{direction="recv",burst="1s",window="1m"} 1010`)
+}
+
+func TestMetrics_Quantiles(t *testing.T) {
+	c := metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{5 * time.Second, time.Minute},
+		Quantiles:     []float64{0.5, 0.9},
+		Tiers: []series.Tier{
+			{Resolution: time.Second, Retention: 10 * time.Second},
+			{Resolution: 5 * time.Second, Retention: time.Minute},
+		},
+	}
+	run := func(c metrics.Config) []string {
+		m := newTester(c)
+		var b []byte
+		for _, v := range []int64{0, 10, 20, 30, 130, 140} {
+			b = m.step(ifaces(v, v))
+		}
+		return lines(b)
+	}
+
+	got := run(c)
+	assertContains(t, got, `netexp_max_burst_bytes_per_second{direction="recv",burst="1s",window="5s"} 100`)
+	assertContains(t, got, `netexp_burst_bytes_per_second{direction="recv",burst="1s",window="5s",quantile="0.5"} 10`)
+	assertContains(t, got, `netexp_burst_bytes_per_second{direction="recv",burst="1s",window="5s",quantile="0.9"} 100`)
+	for _, line := range got {
+		if strings.Contains(line, `window="1m",quantile=`) {
+			t.Errorf("quantile beyond the full resolution tier: %q", line)
+		}
+	}
+
+	c.LegacyNames = true
+	got = run(c)
+	assertContains(t, got, `netexp_p50_1s_recv_burst_bps_over_5s 10`)
+	assertContains(t, got, `netexp_p90_1s_trns_burst_bps_over_5s 100`)
+
+	c.Breakdown = metrics.BreakdownBoth
+	got = run(c)
+	assertContains(t, got, `netexp_p50_1s_recv_burst_bps_over_5s 10`)
+	assertContains(t, got, `netexp_p50_1s_recv_burst_bps_over_5s{iface="eth0"} 10`)
+	assertContains(t, got, `netexp_p90_1s_recv_burst_bps_over_5s{iface="eth0"} 100`)
+}
+
+func TestMetrics_Billing(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval: time.Second,
+		Billing:  &billing.Config{Percentile: 0.95, AnchorDay: 1},
+	})
+	var got []string
+	for i := range 10 * 60 {
+		got = lines(m.step(ifaces(int64(i)*1000, int64(i)*10)))
+	}
+	assertContains(t, got, `netexp_billing_p95_bps{direction="recv",period="current"} 8000`)
+	assertContains(t, got, `netexp_billing_p95_bps{direction="trns",period="current"} 80`)
+	for _, line := range got {
+		if strings.Contains(line, `period="previous"`) {
+			t.Errorf("unexpected previous period: %q", line)
+		}
+	}
+}
+
+func TestMetrics_Accounting(t *testing.T) {
+	c := metrics.Config{
+		Interval:   time.Second,
+		Breakdown:  metrics.BreakdownBoth,
+		Accounting: &metrics.Accounting{MonthStartDay: 1, MonthlyQuota: 1000},
+	}
+	m := newTester(c)
+	m.step(ifaces(100, 10))
+	m.step(ifaces(200, 30))
+	got := lines(m.step(ifaces(50, 5))) // Reset.
+	assertContains(t, got, `netexp_period_bytes{period="day",direction="recv"} 150`)
+	assertContains(t, got, `netexp_period_bytes{period="month",direction="trns"} 25`)
+	assertContains(t, got, `netexp_period_bytes{iface="eth0",period="day",direction="recv"} 150`)
+	assertContains(t, got, `netexp_quota_used_ratio 0.175`)
+
+	// The next day.
+	m.now = m.now.Add(2 * time.Hour)
+	got = lines(m.step(ifaces(60, 5)))
+	assertContains(t, got, `netexp_period_bytes{period="day",direction="recv"} 10`)
+	assertContains(t, got, `netexp_period_bytes{period="month",direction="recv"} 160`)
+
+	// Restarted, with a different interval.
+	c.Interval = 500 * time.Millisecond
+	r := newTester(c)
+	r.now = m.now
+	if err := r.Restore(m.State()); err == nil {
+		t.Error("no error for a different interval")
+	}
+	r.step(ifaces(60, 5))
+	got = lines(r.step(ifaces(70, 5)))
+	assertContains(t, got, `netexp_period_bytes{period="day",direction="recv"} 20`)
+	assertContains(t, got, `netexp_period_bytes{iface="eth0",period="month",direction="recv"} 170`)
+
+	// The next month.
+	r.now = time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)
+	got = lines(r.step(ifaces(80, 5)))
+	assertContains(t, got, `netexp_period_bytes{period="day",direction="recv"} 10`)
+	assertContains(t, got, `netexp_period_bytes{period="month",direction="recv"} 10`)
+	assertContains(t, got, `netexp_quota_used_ratio 0.01`)
+}
+
+func TestMetrics_Links(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		Breakdown:     metrics.BreakdownBoth,
+		LinkSpeeds:    map[string]int64{"veth0": 1200},
+	})
+	links := func(recv int64) []netdev.Iface {
+		eth0 := iface("eth0", recv, 0)
+		eth0.Link = netdev.Link{Speed: 800, Duplex: "full", OperState: "up", MTU: 1500}
+		veth0 := iface("veth0", recv, 0)
+		veth0.Link = netdev.Link{OperState: "up"}
+		return []netdev.Iface{eth0, veth0}
+	}
+	m.step(links(10))
+	m.step(links(60))
+	got := lines(m.step(links(110)))
+	assertContains(t, got, `netexp_link_speed_bps 2000`)
+	assertContains(t, got, `netexp_link_speed_bps{iface="eth0"} 800`)
+	assertContains(t, got, `netexp_link_speed_bps{iface="veth0"} 1200`)
+	assertContains(t, got, `netexp_link_info{iface="eth0",duplex="full",operstate="up"} 1`)
+	assertContains(t, got, `netexp_link_mtu_bytes{iface="eth0"} 1500`)
+	assertContains(t, got, `netexp_max_burst_utilization_ratio{direction="recv",burst="1s",window="2s"} 0.4`)
+	assertContains(t, got, `netexp_max_burst_utilization_ratio{iface="eth0",direction="recv",burst="1s",window="2s"} 0.5`)
+
+	// Without an override, the speed of the total is unknown.
+	m = newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		LegacyNames:   true,
+	})
+	m.step(links(10))
+	m.step(links(60))
+	for _, line := range lines(m.step(links(110))) {
+		if strings.Contains(line, "netexp_link_speed_bps") || strings.Contains(line, "utilization") {
+			t.Errorf("unexpected line: %q", line)
+		}
+	}
+
+	// An interface that is down has no speed, and is left out of the speed of the total.
+	m = newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+	})
+	down := func(recv int64) []netdev.Iface {
+		ifaces := links(recv)
+		ifaces[1].Link = netdev.Link{OperState: "down"}
+		return ifaces
+	}
+	m.step(down(10))
+	m.step(down(60))
+	got = lines(m.step(down(110)))
+	assertContains(t, got, `netexp_link_speed_bps 800`)
+	assertContains(t, got, `netexp_max_burst_utilization_ratio{direction="recv",burst="1s",window="2s"} 1`)
+}
+
+func TestMetrics_Restore(t *testing.T) {
+	c := metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{3 * time.Second},
+		Breakdown:     metrics.BreakdownIface,
+	}
+	m := newTester(c)
+	m.step(ifaces(10, 10))
+	m.step(ifaces(60, 60))
+	m.step(ifaces(70, 70))
+	st := m.State()
+
+	// Restarted right away, the burst is still within the output window.
+	r := newTester(c)
+	r.now = m.now
+	if err := r.Restore(st); err != nil {
+		t.Fatal(err)
+	}
+	got := lines(r.step(ifaces(80, 80)))
+	assertContains(t, got, `netexp_bytes_total{iface="eth0",direction="recv"} 80`)
+	assertContains(t, got, `netexp_max_burst_bytes_per_second{iface="eth0",direction="recv",burst="1s",window="3s"} 50`)
+
+	// Restarted after the output window, the samples are stale,
+	// and the counter was reset by a reboot.
+	r = newTester(c)
+	r.now = m.now.Add(time.Minute)
+	if err := r.Restore(st); err != nil {
+		t.Fatal(err)
+	}
+	got = lines(r.step(ifaces(5, 5)))
+	assertContains(t, got, `netexp_bytes_total{iface="eth0",direction="recv"} 5`)
+	assertContains(t, got, `netexp_counter_resets_total{iface="eth0"} 1`)
+	for _, line := range got {
+		if strings.HasPrefix(line, "netexp_max_") {
+			t.Errorf("unexpected stale burst: %q", line)
+		}
+	}
+
+	// A different interval can't be restored.
+	c.Interval = 500 * time.Millisecond
+	if err := metrics.New(c).Restore(st); err == nil {
+		t.Error("restored a state of a different interval")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{time.Minute},
+		Bursts:        []metrics.Burst{mustBurst("packets:1s:1m")},
+		Groups:        []metrics.Group{{Name: "wired", Ifaces: regexp.MustCompile(`^eth`)}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	tests := []struct {
+		name   string
+		modify func(c *metrics.Config)
+	}{
+		{"zero interval", func(c *metrics.Config) { c.Interval = 0 }},
+		{"burst window not a multiple", func(c *metrics.Config) { c.BurstWindows = []time.Duration{1500 * time.Millisecond} }},
+		{"negative output window", func(c *metrics.Config) { c.OutputWindows = []time.Duration{-time.Minute} }},
+		{"no output windows", func(c *metrics.Config) { c.OutputWindows = nil }},
+		{"burst output window not a multiple", func(c *metrics.Config) { c.Bursts[0].OutputWindows = []time.Duration{time.Millisecond} }},
+		{"burst without counters", func(c *metrics.Config) { c.Bursts[0].Counters = nil }},
+		{"quantile out of range", func(c *metrics.Config) { c.Quantiles = []float64{0.5, 2} }},
+		{"duplicate quantile", func(c *metrics.Config) { c.Quantiles = []float64{0.5, 0.5} }},
+		{"month start day", func(c *metrics.Config) { c.Accounting = &metrics.Accounting{MonthStartDay: 31} }},
+		{"unnamed group", func(c *metrics.Config) { c.Groups[0].Name = "" }},
+		{"group without regexp", func(c *metrics.Config) { c.Groups[0].Ifaces = nil }},
+		{"duplicate group", func(c *metrics.Config) { c.Groups = append(c.Groups, c.Groups[0]) }},
+		{"invalid tiers", func(c *metrics.Config) { c.Tiers = []series.Tier{{Resolution: 2 * time.Second, Retention: time.Hour}} }},
+		{"tiers too short", func(c *metrics.Config) {
+			c.Tiers = []series.Tier{{Resolution: time.Second, Retention: 30 * time.Second}}
+		}},
+	}
+	for _, tt := range tests {
+		c := valid
+		c.Bursts = []metrics.Burst{mustBurst("packets:1s:1m")}
+		c.Groups = slices.Clone(valid.Groups)
+		tt.modify(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for s, want := range map[string]int64{
+		"1000":   1000,
+		"50GB":   50e9,
+		"1.5KiB": 1536,
+		"2 TB":   2e12,
+		"0":      0,
+	} {
+		got, err := metrics.ParseBytes(s)
+		if err != nil || got != want {
+			t.Errorf("ParseBytes(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "GB", "-1GB", "5XB"} {
+		if _, err := metrics.ParseBytes(s); err == nil {
+			t.Errorf("ParseBytes(%q) returned no error", s)
+		}
+	}
+}
+
+func TestParseLinkSpeeds(t *testing.T) {
+	got, err := metrics.ParseLinkSpeeds("eth0=1G, veth0=2.5G,tun0=100000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"eth0": 1e9, "veth0": 2.5e9, "tun0": 1e5}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("incorrect result (-want +got):\n%s", diff)
+	}
+	for _, s := range []string{"eth0", "=1G", "eth0=", "eth0=-1G", "eth0=1X"} {
+		if _, err := metrics.ParseLinkSpeeds(s); err == nil {
+			t.Errorf("ParseLinkSpeeds(%q) returned no error", s)
+		}
+	}
+}
+
+func TestParseBurst(t *testing.T) {
+	got, err := metrics.ParseBurst("packets,recv_drop:1s,5s:1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metrics.Burst{
+		Counters: []netdev.Counter{
+			netdev.RecvPackets,
+			netdev.TrnsPackets,
+			netdev.RecvDrop,
+		},
+		BurstWindows:  []time.Duration{1 * time.Second, 5 * time.Second},
+		OutputWindows: []time.Duration{time.Minute},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("incorrect result (-want +got):\n%s", diff)
+	}
+	for _, s := range []string{
+		"packets:1s",
+		"bogus:1s:1m",
+		"packets:1x:1m",
+		"packets:1s:",
+	} {
+		_, err := metrics.ParseBurst(s)
+		if err == nil {
+			t.Errorf("ParseBurst(%q) returned no error", s)
+		}
+	}
+}
+
+func mustBurst(s string) metrics.Burst {
+	b, err := metrics.ParseBurst(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestMetrics_Fail(t *testing.T) {
+	m := newTester(metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{2 * time.Second},
+		LegacyNames:   true,
+	})
+	m.step(ifaces(10, 10))
+	m.step(ifaces(20, 20))
+	b := m.step(ifaces(30, 30))
+	assertContains(t, lines(b), "netexp_max_1s_recv_burst_bps_over_2s 10")
+
+	m.Fail()
+	m.now = m.now.Add(time.Second)
+	gotLines := lines(m.Append(nil, expfmt.FormatText))
+	wantLines := []string{
+		"netexp_up 0",
+		"netexp_last_collect_success_timestamp_seconds 1700000003",
+	}
+	if diff := lineDiff(wantLines, gotLines); diff != "" {
+		t.Errorf("incorrect result (-want +got):\n%s", diff)
+	}
+
+	// Collection recovers two intervals late,
+	// so there is no burst until one full burst window after the gap.
+	m.now = m.now.Add(time.Second)
+	b = m.step(ifaces(100, 100))
+	gotLines = lines(b)
+	assertContains(t, gotLines, "netexp_up 1")
+	assertContains(t, gotLines, "netexp_last_collect_success_timestamp_seconds 1700000006")
+	assertContains(t, gotLines, "netexp_recv_bytes 100")
+	for _, line := range gotLines {
+		if strings.HasPrefix(line, "netexp_max_") {
+			t.Errorf("unexpected burst right after a gap: %q", line)
+		}
+	}
+
+	b = m.step(ifaces(110, 110))
+	assertContains(t, lines(b), "netexp_max_1s_recv_burst_bps_over_2s 10")
+}
+
+// tester steps Metrics one interval at a time, as the main loop would.
+type tester struct {
+	*metrics.Metrics
+	now time.Time
+}
+
+func newTester(c metrics.Config) *tester {
+	return &tester{
+		Metrics: metrics.New(c),
+		now:     time.Unix(1700000000, 0),
+	}
+}
+
+// step records ifaces one interval after the previous step
+// and returns the metrics in the text format.
+func (m *tester) step(ifaces []netdev.Iface) []byte {
+	m.now = m.now.Add(m.Interval)
+	m.Step(m.now, ifaces)
+	return m.Append(nil, expfmt.FormatText)
+}
+
+// statusLines returns the legacy lines of the collection status
+// after a successful step.
+func (m *tester) statusLines() []string {
+	return []string{
+		"netexp_up 1",
+		fmt.Sprintf("netexp_last_collect_success_timestamp_seconds %d", m.now.Unix()),
+	}
+}
+
+func assertContains(t *testing.T, lines []string, line string) {
+	t.Helper()
+	if !slices.Contains(lines, line) {
+		t.Errorf("missing line %q", line)
+	}
+}
+
+func iface(name string, recv, trns int64) netdev.Iface {
+	return netdev.Iface{
+		Name: name,
+		Stats: netdev.Stats{
+			netdev.RecvBytes: recv,
+			netdev.TrnsBytes: trns,
+		},
+	}
+}
+
+func ifaces(recv, trns int64) []netdev.Iface {
+	return []netdev.Iface{iface("eth0", recv, trns)}
+}
+
+// withDefaults adds the lines of the collection status,
+// and the lines of the counters other than bytes and of the reset counter,
+// which the tests leave at zero unless listed in want,
+// for each of the given label sets.
+func (m *tester) withDefaults(want []string, labels ...string) []string {
+	want = append(slices.Clone(want), m.statusLines()...)
+	for _, ls := range labels {
+		names := []string{"netexp_counter_resets_total" + ls}
+		for c := range netdev.NumCounters {
+			if c != netdev.RecvBytes && c != netdev.TrnsBytes {
+				names = append(names, fmt.Sprintf("netexp_%s%s", c, ls))
+			}
+		}
+		for _, name := range names {
+			listed := slices.ContainsFunc(want, func(line string) bool {
+				return strings.HasPrefix(line, name+" ")
+			})
+			if !listed {
+				want = append(want, name+" 0")
+			}
+		}
+	}
+	return want
+}
+
 func lines(b []byte) (s []string) {
 	for line := range bytes.SplitSeq(b, []byte{'\n'}) {
 		if len(line) > 0 {
@@ -0,0 +1,508 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/expfmt"
+	"github.com/layer8co/netexp/internal/netdev"
+)
+
+// family describes how the counters of one kind (e.g. "drop") are exported.
+type family struct {
+	kind     string
+	counters []netdev.Counter
+
+	total     string // e.g. netexp_drops_total
+	totalHelp string
+	unit      string
+	burst     string // e.g. netexp_max_burst_drops_per_second
+	burstHelp string
+
+	quantile     string // e.g. netexp_burst_drops_per_second
+	quantileHelp string
+}
+
+// Nouns of each counter kind, as used in metric names and help texts.
+var kindNouns = map[string]struct{ name, help string }{
+	"bytes":      {"bytes", "bytes"},
+	"packets":    {"packets", "packets"},
+	"errs":       {"errors", "errors"},
+	"drop":       {"drops", "dropped packets"},
+	"fifo":       {"fifo_errors", "FIFO buffer errors"},
+	"frame":      {"frame_errors", "packet framing errors"},
+	"compressed": {"compressed_packets", "compressed packets"},
+	"multicast":  {"multicast_packets", "multicast frames"},
+	"colls":      {"collisions", "collisions"},
+	"carrier":    {"carrier_errors", "carrier losses"},
+}
+
+// Families in the order of the columns of /proc/net/dev.
+var families []family
+
+var legacyCounterNames [netdev.NumCounters]string
+
+func init() {
+	for c := range netdev.NumCounters {
+		legacyCounterNames[c] = "netexp_" + c.String()
+		i := 0
+		for i < len(families) && families[i].kind != c.Kind() {
+			i++
+		}
+		if i == len(families) {
+			families = append(families, family{kind: c.Kind()})
+		}
+		families[i].counters = append(families[i].counters, c)
+	}
+	for i := range families {
+		f := &families[i]
+		noun := kindNouns[f.kind]
+		verb := "received or transmitted"
+		if len(f.counters) == 1 && f.counters[0].Direction() == "recv" {
+			verb = "received"
+		} else if len(f.counters) == 1 {
+			verb = "transmitted"
+		}
+		f.total = "netexp_" + noun.name + "_total"
+		if f.kind == "bytes" {
+			f.unit = "bytes"
+		}
+		f.totalHelp = "Number of " + noun.help + " " + verb + " by the matched interfaces."
+		f.burst = "netexp_max_burst_" + noun.name + "_per_second"
+		f.burstHelp = "Maximum rate of " + noun.help + " " + verb + " per second over a burst window, within an output window."
+		f.quantile = "netexp_burst_" + noun.name + "_per_second"
+		f.quantileHelp = "Quantiles of the rate of " + noun.help + " " + verb + " per second over a burst window, within an output window."
+	}
+}
+
+const (
+	resetsName = "netexp_counter_resets_total"
+	resetsHelp = "Number of times the counters of the matched interfaces went down."
+
+	upName       = "netexp_up"
+	upHelp       = "Whether the last collection of the interface counters succeeded."
+	lastStepName = "netexp_last_collect_success_timestamp_seconds"
+	lastStepHelp = "Unix time of the last successful collection of the interface counters."
+	lastStepUnit = "seconds"
+
+	linkSpeedName = "netexp_link_speed_bps"
+	linkSpeedHelp = "Speed of the links of the matched interfaces, in bits per second."
+	linkInfoName  = "netexp_link_info"
+	linkInfoHelp  = "Duplex and operational state of the link of an interface."
+	linkMTUName   = "netexp_link_mtu_bytes"
+	linkMTUHelp   = "MTU of the link of an interface."
+
+	utilizationName = "netexp_max_burst_utilization_ratio"
+	utilizationHelp = "Maximum rate of bytes received or transmitted over a burst window, within an output window, as a fraction of the link speed."
+
+	periodName = "netexp_period_bytes"
+	periodHelp = "Number of bytes received or transmitted by the matched interfaces in the current day or month."
+	quotaName  = "netexp_quota_used_ratio"
+	quotaHelp  = "Fraction of the monthly quota used by the bytes received and transmitted in the current month."
+
+	billingName = "netexp_billing_p95_bps"
+	billingHelp = "Percentile (the 95th unless configured otherwise) of the 5-minute average rates of bits received or transmitted by the matched interfaces over a billing period, in bits per second."
+)
+
+// Append appends the metrics of the last step to b in the given format,
+// keeping all lines of a metric name together.
+func (m *Metrics) Append(b []byte, f expfmt.Format) []byte {
+	m.w.Reset(b, f)
+	m.writeStatus()
+	if m.up {
+		if m.LegacyNames {
+			m.writeLegacy()
+		} else {
+			m.write()
+		}
+		m.writeLinks()
+		if m.Accounting != nil {
+			m.writePeriods()
+		}
+		if m.billing != nil {
+			m.writeBilling()
+		}
+	}
+	m.w.End()
+	b = m.w.Bytes()
+	b = bytes.TrimRight(b, "\n")
+	return b
+}
+
+// writeStatus writes the status of the collection,
+// which is written in every mode and whether or not collection is failing.
+func (m *Metrics) writeStatus() {
+	w := &m.w
+	up := int64(0)
+	if m.up {
+		up = 1
+	}
+	if !m.LegacyNames {
+		w.Family(upName, expfmt.Gauge, "", upHelp)
+	}
+	w.Int(upName, nil, up)
+	if !m.lastStep.IsZero() {
+		if !m.LegacyNames {
+			w.Family(lastStepName, expfmt.Gauge, lastStepUnit, lastStepHelp)
+		}
+		w.Float(lastStepName, nil, float64(m.lastStep.UnixMilli())/1e3)
+	}
+}
+
+func (m *Metrics) write() {
+	w := &m.w
+	for _, f := range families {
+		w.Family(f.total, expfmt.Counter, f.unit, f.totalHelp)
+		for _, c := range f.counters {
+			for _, g := range m.active {
+				w.Int(f.total, m.withLabels(g, "direction", c.Direction()), g.now[c])
+			}
+		}
+	}
+	w.Family(resetsName, expfmt.Counter, "", resetsHelp)
+	for _, g := range m.active {
+		w.Int(resetsName, g.labels, g.resets)
+	}
+	for _, f := range families {
+		started := false
+		for i := range m.trackers {
+			t := &m.trackers[i]
+			if t.counter.Kind() != f.kind {
+				continue
+			}
+			for j, ow := range t.outputWindows {
+				for _, g := range m.active {
+					maxBurst, ok := g.bursts[i].Max(ow)
+					if !ok {
+						continue
+					}
+					if !started {
+						w.Family(f.burst, expfmt.Gauge, "", f.burstHelp)
+						started = true
+					}
+					labels := m.withLabels(g,
+						"direction", t.counter.Direction(),
+						"burst", t.burstLabel,
+						"window", t.windowLabels[j],
+					)
+					writeScaled(w, f.burst, labels, maxBurst, t.scale)
+				}
+			}
+		}
+		if len(m.Quantiles) > 0 {
+			m.writeQuantiles(f)
+		}
+		if f.kind == "bytes" {
+			m.writeUtilization()
+		}
+	}
+}
+
+func (m *Metrics) writeQuantiles(f family) {
+	w := &m.w
+	started := false
+	for i := range m.trackers {
+		t := &m.trackers[i]
+		if t.counter.Kind() != f.kind {
+			continue
+		}
+		for j, ow := range t.outputWindows {
+			for _, g := range m.active {
+				if !g.bursts[i].Quantiles(ow, m.Quantiles, m.quantiles) {
+					continue
+				}
+				if !started {
+					w.Family(f.quantile, expfmt.Gauge, "", f.quantileHelp)
+					started = true
+				}
+				for k, v := range m.quantiles {
+					labels := m.withLabels(g,
+						"direction", t.counter.Direction(),
+						"burst", t.burstLabel,
+						"window", t.windowLabels[j],
+						"quantile", m.quantileLabels[k],
+					)
+					writeScaled(w, f.quantile, labels, v, t.scale)
+				}
+			}
+		}
+	}
+}
+
+// writeUtilization writes the maximum byte burst rates as a fraction of the link speed.
+func (m *Metrics) writeUtilization() {
+	w := &m.w
+	started := false
+	for i := range m.trackers {
+		t := &m.trackers[i]
+		if t.counter.Kind() != "bytes" {
+			continue
+		}
+		for j, ow := range t.outputWindows {
+			for _, g := range m.active {
+				ratio, ok := g.utilization(i, ow)
+				if !ok {
+					continue
+				}
+				if !started {
+					w.Family(utilizationName, expfmt.Gauge, "ratio", utilizationHelp)
+					started = true
+				}
+				labels := m.withLabels(g,
+					"direction", t.counter.Direction(),
+					"burst", t.burstLabel,
+					"window", t.windowLabels[j],
+				)
+				w.Float(utilizationName, labels, ratio)
+			}
+		}
+	}
+}
+
+// utilization returns the maximum burst of tracker i over output window ow,
+// which has to be of a byte counter, as a fraction of the link speed of g.
+func (g *group) utilization(i int, ow time.Duration) (float64, bool) {
+	if g.speed == 0 {
+		return 0, false
+	}
+	maxBurst, ok := g.bursts[i].Max(ow)
+	if !ok {
+		return 0, false
+	}
+	return float64(maxBurst*8) / float64(g.speed), true
+}
+
+// writeLinks writes the link speed of each exported label set,
+// and the other link details of each interface.
+func (m *Metrics) writeLinks() {
+	w := &m.w
+	started := false
+	for _, g := range m.active {
+		if g.speed == 0 {
+			continue
+		}
+		if !started && !m.LegacyNames {
+			w.Family(linkSpeedName, expfmt.Gauge, "", linkSpeedHelp)
+		}
+		started = true
+		w.Int(linkSpeedName, g.labels, g.speed)
+	}
+	started = false
+	for _, g := range m.active {
+		if g.link == nil || g.link.OperState == "" {
+			continue
+		}
+		if !started && !m.LegacyNames {
+			w.Family(linkInfoName, expfmt.Gauge, "", linkInfoHelp)
+		}
+		started = true
+		w.Int(linkInfoName, m.withLabels(g, "duplex", g.link.Duplex, "operstate", g.link.OperState), 1)
+	}
+	started = false
+	for _, g := range m.active {
+		if g.link == nil || g.link.MTU == 0 {
+			continue
+		}
+		if !started && !m.LegacyNames {
+			w.Family(linkMTUName, expfmt.Gauge, "bytes", linkMTUHelp)
+		}
+		started = true
+		w.Int(linkMTUName, g.labels, g.link.MTU)
+	}
+}
+
+func (m *Metrics) writeLegacy() {
+	w := &m.w
+	for c := range netdev.NumCounters {
+		for _, g := range m.active {
+			w.Int(legacyCounterNames[c], g.labels, g.now[c])
+		}
+	}
+	for _, g := range m.active {
+		w.Int(resetsName, g.labels, g.resets)
+	}
+	for i := range m.trackers {
+		t := &m.trackers[i]
+		for j, ow := range t.outputWindows {
+			for _, g := range m.active {
+				maxBurst, ok := g.bursts[i].Max(ow)
+				if ok {
+					writeScaled(w, t.legacyNames[j], g.labels, maxBurst, t.scale)
+				}
+			}
+			if t.counter.Kind() == "bytes" {
+				for _, g := range m.active {
+					ratio, ok := g.utilization(i, ow)
+					if ok {
+						w.Float(t.legacyUtilizationNames[j], g.labels, ratio)
+					}
+				}
+			}
+			if len(m.Quantiles) == 0 {
+				continue
+			}
+			// Quantiles sorts the window, so all of them are taken at once
+			// for each group, and then written name by name.
+			n := len(m.Quantiles)
+			m.groupQuantiles = slices.Grow(m.groupQuantiles[:0], n*len(m.active))[:n*len(m.active)]
+			m.hasGroupQuantiles = m.hasGroupQuantiles[:0]
+			for l, g := range m.active {
+				ok := g.bursts[i].Quantiles(ow, m.Quantiles, m.groupQuantiles[l*n:(l+1)*n])
+				m.hasGroupQuantiles = append(m.hasGroupQuantiles, ok)
+			}
+			for k, name := range t.legacyQuantileNames[j] {
+				for l, g := range m.active {
+					if m.hasGroupQuantiles[l] {
+						writeScaled(w, name, g.labels, m.groupQuantiles[l*n+k], t.scale)
+					}
+				}
+			}
+		}
+	}
+}
+
+// writePeriods writes the totals of the current day and month,
+// and the fraction of the monthly quota that is used.
+func (m *Metrics) writePeriods() {
+	w := &m.w
+	if !m.LegacyNames {
+		w.Family(periodName, expfmt.Gauge, "bytes", periodHelp)
+	}
+	for _, g := range m.active {
+		for i, direction := range [...]string{"recv", "trns"} {
+			w.Int(periodName, m.withLabels(g, "period", "day", "direction", direction), g.period.Day[i])
+		}
+		for i, direction := range [...]string{"recv", "trns"} {
+			w.Int(periodName, m.withLabels(g, "period", "month", "direction", direction), g.period.Month[i])
+		}
+	}
+	if m.Accounting.MonthlyQuota == 0 {
+		return
+	}
+	if !m.LegacyNames {
+		w.Family(quotaName, expfmt.Gauge, "ratio", quotaHelp)
+	}
+	for _, g := range m.active {
+		used := g.period.Month[0] + g.period.Month[1]
+		w.Float(quotaName, g.labels, float64(used)/float64(m.Accounting.MonthlyQuota))
+	}
+}
+
+// writeBilling writes the billed rates of the current and the previous billing period.
+func (m *Metrics) writeBilling() {
+	w := &m.w
+	if !m.LegacyNames {
+		w.Family(billingName, expfmt.Gauge, "", billingHelp)
+	}
+	periods := []struct {
+		name  string
+		rates func() (billing.Rates, bool)
+	}{
+		{"current", m.billing.Current},
+		{"previous", m.billing.Previous},
+	}
+	for _, p := range periods {
+		rates, ok := p.rates()
+		if !ok {
+			continue
+		}
+		for i, direction := range [...]string{billing.Recv: "recv", billing.Trns: "trns"} {
+			m.labels = append(m.labels[:0],
+				expfmt.Label{Name: "direction", Value: direction},
+				expfmt.Label{Name: "period", Value: p.name},
+			)
+			w.Int(billingName, m.labels, rates[i])
+		}
+	}
+}
+
+// withLabels returns the labels of g followed by the given name/value pairs.
+// The returned slice is only valid until the next call.
+func (m *Metrics) withLabels(g *group, pairs ...string) []expfmt.Label {
+	m.labels = append(m.labels[:0], g.labels...)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		m.labels = append(m.labels, expfmt.Label{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return m.labels
+}
+
+// legacyName returns the legacy name of the burst metric of t over output window ow.
+func (t *tracker) legacyName(ow time.Duration) string {
+	return t.legacyStatName("max", ow)
+}
+
+// legacyQuantileName returns the legacy name of the q-quantile burst metric of t
+// over output window ow, e.g. netexp_p99_1s_recv_burst_bps_over_1m0s.
+func (t *tracker) legacyQuantileName(ow time.Duration, q float64) string {
+	percent := strconv.FormatFloat(math.Round(q*100*1e6)/1e6, 'f', -1, 64)
+	return t.legacyStatName("p"+strings.ReplaceAll(percent, ".", "_"), ow)
+}
+
+// legacyStatName returns the legacy name of a statistic of the burst rates of t
+// over output window ow, e.g. netexp_max_1s_recv_burst_bps_over_1m0s for "max".
+func (t *tracker) legacyStatName(stat string, ow time.Duration) string {
+	if t.counter.Kind() == "bytes" {
+		return fmt.Sprintf(
+			"netexp_%s_%s_%s_burst_bps_over_%s",
+			stat, t.burstWindow, t.counter.Direction(), ow,
+		)
+	}
+	return fmt.Sprintf(
+		"netexp_%s_%s_%s_burst_per_second_over_%s",
+		stat, t.burstWindow, t.counter, ow,
+	)
+}
+
+// legacyUtilizationName returns the legacy name of the utilization metric of t
+// over output window ow, e.g. netexp_max_1s_recv_burst_utilization_ratio_over_1m0s.
+func (t *tracker) legacyUtilizationName(ow time.Duration) string {
+	return fmt.Sprintf(
+		"netexp_max_%s_%s_burst_utilization_ratio_over_%s",
+		t.burstWindow, t.counter.Direction(), ow,
+	)
+}
+
+// writeScaled writes v/scale.
+func writeScaled(w *expfmt.Writer, name string, labels []expfmt.Label, v, scale int64) {
+	if scale == 1 {
+		w.Int(name, labels, v)
+	} else {
+		w.Float(name, labels, float64(v)/float64(scale))
+	}
+}
+
+// formatDuration formats d the way Prometheus does, e.g. "1m" or "1h30m",
+// rather than the way time.Duration does, e.g. "1m0s" or "1h30m0s".
+func formatDuration(d time.Duration) string {
+	if d <= 0 || d%time.Millisecond != 0 {
+		return d.String()
+	}
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	}
+	var b []byte
+	for _, u := range units {
+		if n := d / u.d; n > 0 {
+			b = strconv.AppendInt(b, int64(n), 10)
+			b = append(b, u.name...)
+			d -= n * u.d
+		}
+	}
+	return string(b)
+}
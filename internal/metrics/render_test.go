@@ -0,0 +1,26 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Second:                         "1s",
+		time.Minute:                         "1m",
+		90 * time.Second:                    "1m30s",
+		500 * time.Millisecond:              "500ms",
+		1500 * time.Millisecond:             "1s500ms",
+		36 * time.Hour:                      "1d12h",
+		time.Hour + 10*time.Millisecond:     "1h10ms",
+		time.Millisecond + time.Microsecond: "1.001ms",
+	} {
+		assert.Equal(t, want, formatDuration(d), "%s", d)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/layer8co/netexp/internal/billing"
+	"github.com/layer8co/netexp/internal/netdev"
+	"github.com/layer8co/netexp/internal/series"
+)
+
+// State is the state of Metrics, as saved across restarts.
+type State struct {
+	Interval time.Duration         `json:"interval"`
+	LastStep time.Time             `json:"last_step"`
+	Total    GroupState            `json:"total"`
+	Groups   map[string]GroupState `json:"groups,omitempty"`
+	Ifaces   map[string]IfaceState `json:"ifaces,omitempty"`
+	Billing  *billing.State        `json:"billing,omitempty"`
+	Periods  *PeriodsState         `json:"periods,omitempty"`
+}
+
+// PeriodsState is the state of the totals of Config.Accounting.
+type PeriodsState struct {
+	Day    time.Time               `json:"day"`
+	Month  time.Time               `json:"month"`
+	Total  PeriodTotals            `json:"total"`
+	Groups map[string]PeriodTotals `json:"groups,omitempty"`
+	Ifaces map[string]PeriodTotals `json:"ifaces,omitempty"`
+}
+
+// GroupState is the state of the series of one exported label set.
+type GroupState struct {
+	Now      netdev.Stats            `json:"now"`
+	Resets   int64                   `json:"resets"`
+	Counters map[string]series.State `json:"counters,omitempty"` // By counter name.
+	Bursts   []BurstState            `json:"bursts,omitempty"`
+}
+
+// BurstState is the state of the burst series of one counter and burst window.
+type BurstState struct {
+	Counter     string             `json:"counter"`
+	BurstWindow time.Duration      `json:"burst_window"`
+	Series      series.TieredState `json:"series"`
+}
+
+// IfaceState is the state of one matched interface.
+type IfaceState struct {
+	Prev  netdev.Stats `json:"prev"`
+	Group *GroupState  `json:"group,omitempty"` // nil unless the breakdown includes interfaces.
+}
+
+// State returns the state of m.
+func (m *Metrics) State() *State {
+	st := &State{
+		Interval: m.Interval,
+		LastStep: m.lastStep,
+		Total:    m.groupState(m.total),
+		Groups:   make(map[string]GroupState),
+		Ifaces:   make(map[string]IfaceState),
+	}
+	for _, g := range m.groups {
+		st.Groups[g.name] = m.groupState(g)
+	}
+	if m.billing != nil {
+		st.Billing = m.billing.State()
+	}
+	if m.Accounting != nil {
+		ps := &PeriodsState{
+			Day:    m.periods.day,
+			Month:  m.periods.month,
+			Total:  *m.total.period,
+			Groups: make(map[string]PeriodTotals),
+			Ifaces: make(map[string]PeriodTotals),
+		}
+		for _, g := range m.groups {
+			ps.Groups[g.name] = *g.period
+		}
+		for name, pt := range m.periods.ifaces {
+			ps.Ifaces[name] = *pt
+		}
+		st.Periods = ps
+	}
+	for _, x := range m.ifaces {
+		xs := IfaceState{Prev: x.prev}
+		if x.group != nil {
+			gs := m.groupState(x.group)
+			xs.Group = &gs
+		}
+		st.Ifaces[x.id] = xs
+	}
+	return st
+}
+
+func (m *Metrics) groupState(g *group) GroupState {
+	gs := GroupState{
+		Now:      g.now,
+		Resets:   g.resets,
+		Counters: make(map[string]series.State),
+	}
+	for c, s := range g.counters {
+		if s != nil {
+			gs.Counters[netdev.Counter(c).String()] = s.State()
+		}
+	}
+	for i, t := range m.trackers {
+		gs.Bursts = append(gs.Bursts, BurstState{
+			Counter:     t.counter.String(),
+			BurstWindow: t.burstWindow,
+			Series:      g.bursts[i].State(),
+		})
+	}
+	return gs
+}
+
+// Restore restores the state of m, which has to be new, from st.
+// Series that don't fit the current configuration,
+// e.g. because their burst window is no longer tracked, are left out,
+// and the intervals that passed since st was saved are recorded as a gap
+// by the next Step, which pushes the samples older than the windows out.
+// If the interval changed, nothing but the billing samples and the period totals is restored.
+func (m *Metrics) Restore(st *State) error {
+	if m.started {
+		panic("Metrics.Restore: metrics already have samples")
+	}
+	var errs []error
+	if m.billing != nil && st.Billing != nil {
+		bs := *st.Billing
+		if st.Interval != m.Interval || st.LastStep.IsZero() {
+			// The counters that the sample in progress started from aren't restored.
+			bs.Sample = nil
+		}
+		errs = append(errs, m.billing.Restore(&bs))
+	}
+	if m.Accounting != nil && st.Periods != nil {
+		m.restorePeriods(st.Periods)
+	}
+	if st.Interval != m.Interval {
+		errs = append(errs, fmt.Errorf("interval %s of the saved state is not %s", st.Interval, m.Interval))
+		return errors.Join(errs...)
+	}
+	if st.LastStep.IsZero() {
+		return errors.Join(errs...)
+	}
+	m.lastStep = st.LastStep
+	m.started = true
+
+	errs = append(errs, m.restoreGroup(m.total, &st.Total))
+	for _, g := range m.groups {
+		gs, ok := st.Groups[g.name]
+		if ok {
+			errs = append(errs, m.restoreGroup(g, &gs))
+		}
+	}
+	for id, xs := range st.Ifaces {
+		x := m.newIface(id, &xs.Prev)
+		if x.group != nil && xs.Group != nil {
+			errs = append(errs, m.restoreGroup(x.group, xs.Group))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restoreGroup restores the series of g from gs.
+// Series that can't be restored are replaced with empty ones.
+func (m *Metrics) restoreGroup(g *group, gs *GroupState) error {
+	g.now = gs.Now
+	g.resets = gs.Resets
+	// Empty series to replace the ones that fail to restore with.
+	var fresh *group
+	empty := func() *group {
+		if fresh == nil {
+			fresh = m.newGroup(g.name, g.labels)
+		}
+		return fresh
+	}
+	var errs []error
+	for name, s := range gs.Counters {
+		c, err := netdev.ParseCounter(name)
+		if err != nil || g.counters[c] == nil {
+			continue
+		}
+		err = g.counters[c].Restore(s)
+		if err != nil {
+			g.counters[c] = empty().counters[c]
+			errs = append(errs, fmt.Errorf("could not restore %s of %q: %w", name, g.name, err))
+		}
+	}
+	for _, bs := range gs.Bursts {
+		for i, t := range m.trackers {
+			if t.counter.String() != bs.Counter || t.burstWindow != bs.BurstWindow {
+				continue
+			}
+			err := g.bursts[i].Restore(bs.Series)
+			if err != nil {
+				g.bursts[i] = empty().bursts[i]
+				errs = append(errs, fmt.Errorf("could not restore %s burst of %s of %q: %w", formatDuration(t.burstWindow), bs.Counter, g.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restorePeriods restores the totals of the current day and month from ps.
+// Totals of a day or month that is over are set to zero by the next Step.
+func (m *Metrics) restorePeriods(ps *PeriodsState) {
+	m.periods.day = ps.Day
+	m.periods.month = ps.Month
+	*m.total.period = ps.Total
+	for _, g := range m.groups {
+		*g.period = ps.Groups[g.name]
+	}
+	for id, pt := range ps.Ifaces {
+		*m.ifacePeriod(id) = pt
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import "os"
+
+// Where the procfs and the sysfs of the host are mounted,
+// which in a container is usually elsewhere than /proc and /sys,
+// and their display names.
+const (
+	hostProcName = "${HOST_PROC:-/proc}"
+	hostSysName  = "${HOST_SYS:-/sys}"
+)
+
+var (
+	hostProc = hostDir("HOST_PROC", "/proc")
+	hostSys  = hostDir("HOST_SYS", "/sys")
+)
+
+// hostDir returns the value of the environment variable env, or def if it is empty.
+func hostDir(env, def string) string {
+	if dir := os.Getenv(env); dir != "" {
+		return dir
+	}
+	return def
+}
+
+// HostProc returns where the procfs of the host is mounted: $HOST_PROC, or /proc.
+func HostProc() string {
+	return hostProc
+}
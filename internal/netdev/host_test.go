@@ -0,0 +1,98 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHost is a procfs and a sysfs in a temporary directory,
+// for NetDev and DefaultRoutes to read instead of the host's.
+type fakeHost struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeHost(t *testing.T) *fakeHost {
+	t.Helper()
+	return &fakeHost{t: t, root: t.TempDir()}
+}
+
+// path returns the path of the file at name, e.g. "proc/net/dev", in h.
+func (h *fakeHost) path(name string) string {
+	return filepath.Join(h.root, filepath.FromSlash(name))
+}
+
+// newNetDev returns a NetDev that reads h.
+func (h *fakeHost) newNetDev(ifaceMatcher MatchFunc) *NetDev {
+	d := New(ifaceMatcher, nil)
+	d.setHost(h.path("proc"), h.path("sys"))
+	return d
+}
+
+// newDefaultRoutes returns a DefaultRoutes that reads h.
+func (h *fakeHost) newDefaultRoutes() *DefaultRoutes {
+	r := NewDefaultRoutes(nil)
+	r.setHost(h.path("proc"))
+	return r
+}
+
+// write writes content to the file at name, making its directories.
+func (h *fakeHost) write(name, content string) {
+	h.t.Helper()
+	require.NoError(h.t, os.MkdirAll(filepath.Dir(h.path(name)), 0o755))
+	require.NoError(h.t, os.WriteFile(h.path(name), []byte(content), 0o644))
+}
+
+// symlink makes the file at name a symbolic link to target, making its directories.
+func (h *fakeHost) symlink(name, target string) {
+	h.t.Helper()
+	require.NoError(h.t, os.MkdirAll(filepath.Dir(h.path(name)), 0o755))
+	require.NoError(h.t, os.Symlink(target, h.path(name)))
+}
+
+// remove removes the file or directory at name.
+func (h *fakeHost) remove(name string) {
+	h.t.Helper()
+	require.NoError(h.t, os.RemoveAll(h.path(name)))
+}
+
+// links writes the given files of the directory of each interface
+// to the class/net of the sysfs at dir, e.g. "sys".
+func (h *fakeHost) links(dir string, ifaces map[string]map[string]string) {
+	h.t.Helper()
+	for name, files := range ifaces {
+		require.NoError(h.t, os.MkdirAll(h.path(dir+"/class/net/"+name), 0o755))
+		for file, content := range files {
+			h.write(dir+"/class/net/"+name+"/"+file, content+"\n")
+		}
+	}
+}
+
+// process writes the process pid in the network namespace netns,
+// with the namespace as the bytes received and transmitted by its eth0.
+func (h *fakeHost) process(pid int, netns string) {
+	h.t.Helper()
+	dir := "proc/" + strconv.Itoa(pid)
+	h.symlink(dir+"/ns/net", "net:["+netns+"]")
+	h.write(dir+"/net/dev", fmt.Sprintf(containerData, netns, netns))
+}
+
+// processes writes each process in the network namespace given by its pid,
+// along with entries of the procfs that aren't processes, and a process that exited.
+func (h *fakeHost) processes(netns map[int]string) {
+	h.t.Helper()
+	for pid, id := range netns {
+		h.process(pid, id)
+	}
+	h.symlink("proc/self", "1")
+	require.NoError(h.t, os.MkdirAll(h.path("proc/sys"), 0o755))
+	require.NoError(h.t, os.MkdirAll(h.path("proc/99"), 0o755))
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// How long the link details of an interface are cached for.
+const linkRefresh = time.Minute
+
+const sysClassNetName = hostSysName + "/class/net"
+
+// Link holds the details of the link of a network interface,
+// as found in /sys/class/net/<iface>.
+type Link struct {
+	Speed     int64  // In bits per second, or 0 if unknown, e.g. for virtual interfaces.
+	Duplex    string // e.g. "full", or "" if unknown.
+	OperState string // e.g. "up".
+	MTU       int64
+
+	// Index of the interface, and of the one it is linked to,
+	// which for a veth is its peer, maybe in another network namespace.
+	IfIndex, IfLink int
+}
+
+// cachedLink is the link of an interface and when it was read.
+type cachedLink struct {
+	link Link
+	read time.Time
+}
+
+// Down reports whether the interface is down, or stacked on one that is,
+// so that it can't carry traffic, by its operational state.
+func (l *Link) Down() bool {
+	switch l.OperState {
+	case "down", "lowerlayerdown", "notpresent":
+		return true
+	}
+	return false
+}
+
+// readLink reads the link details of the named interface from dir.
+// The speed and duplex of interfaces that don't report them,
+// or that are down, are left unknown.
+func readLink(dir, name string) (link Link, err error) {
+	dir = filepath.Join(dir, name)
+	read := func(file string) ([]byte, error) {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		return bytes.TrimSpace(b), err
+	}
+	b, err := read("operstate")
+	if err != nil {
+		return link, fmt.Errorf("could not read link of %q from %q: %w", name, sysClassNetName, err)
+	}
+	link.OperState = string(b)
+	b, err = read("mtu")
+	if err == nil {
+		link.MTU, _ = strconv.ParseInt(string(b), 10, 64)
+	}
+	b, err = read("ifindex")
+	if err == nil {
+		link.IfIndex, _ = strconv.Atoi(string(b))
+	}
+	b, err = read("iflink")
+	if err == nil {
+		link.IfLink, _ = strconv.Atoi(string(b))
+	}
+	// Reading the speed and duplex of an interface that is down fails with EINVAL.
+	b, err = read("speed")
+	if err == nil {
+		mbps, err := strconv.ParseInt(string(b), 10, 64)
+		if err == nil && mbps > 0 {
+			link.Speed = mbps * 1e6
+		}
+	}
+	b, err = read("duplex")
+	if err == nil && string(b) != "unknown" {
+		link.Duplex = string(b)
+	}
+	return link, nil
+}
+
+// readLinks sets the link of each of ifaces, reading the ones that aren't cached.
+// Interfaces whose link can't be read, or that are in another network namespace
+// than netexp, are given an empty one.
+func (d *NetDev) readLinks(ifaces []Iface, now time.Time) {
+	if d.links == nil {
+		d.links = make(map[string]*cachedLink)
+	}
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if !d.own(iface) {
+			iface.Link = Link{}
+			continue
+		}
+		c := d.links[iface.Name]
+		if c == nil {
+			c = new(cachedLink)
+			d.links[iface.Name] = c
+		}
+		if c.read.IsZero() || now.Sub(c.read) >= linkRefresh {
+			c.link, _ = readLink(d.linkDir, iface.Name)
+			c.read = now
+		}
+		iface.Link = c.link
+	}
+	if len(d.links) > len(ifaces) {
+		maps.DeleteFunc(d.links, func(name string, _ *cachedLink) bool {
+			return !slices.ContainsFunc(ifaces, func(iface Iface) bool { return iface.Name == name })
+		})
+	}
+}
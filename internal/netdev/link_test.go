@@ -0,0 +1,45 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadLinks(t *testing.T) {
+	h := newFakeHost(t)
+	h.links("sys", map[string]map[string]string{
+		"eth0":   {"speed": "1000", "duplex": "full", "operstate": "up", "mtu": "1500", "ifindex": "2", "iflink": "2"},
+		"enp3s0": {"speed": "-1", "duplex": "unknown", "operstate": "down", "mtu": "9000"},
+		// wlan0 reports no speed.
+		"wlan0": {"operstate": "dormant", "mtu": "1500"},
+	})
+
+	d := h.newNetDev(ifaceRegexp.Match)
+	r.Seek(0, io.SeekStart)
+	_, err := d.parse(r)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	d.readLinks(d.ifaces, now)
+	assert.Equal(t, Link{Speed: 1e9, Duplex: "full", OperState: "up", MTU: 1500, IfIndex: 2, IfLink: 2}, d.ifaces[0].Link)
+	assert.Equal(t, Link{OperState: "down", MTU: 9000}, d.ifaces[1].Link)
+	assert.Equal(t, Link{OperState: "dormant", MTU: 1500}, d.ifaces[2].Link)
+
+	// Links are cached for a while.
+	h.links("sys", map[string]map[string]string{"eth0": {"speed": "100"}})
+	d.readLinks(d.ifaces, now.Add(time.Second))
+	assert.Equal(t, int64(1e9), d.ifaces[0].Link.Speed)
+	d.readLinks(d.ifaces, now.Add(linkRefresh))
+	assert.Equal(t, int64(100e6), d.ifaces[0].Link.Speed)
+}
+
+func TestReadLink_Missing(t *testing.T) {
+	_, err := readLink(t.TempDir(), "eth0")
+	assert.Error(t, err)
+}
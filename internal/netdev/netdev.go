@@ -9,10 +9,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
+	"log/slog"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/layer8co/toolbox/oslite"
+
+	"github.com/layer8co/netexp/internal/container"
 )
 
 const (
@@ -25,62 +30,234 @@ const (
 	netdevFirstLine = 3
 
 	// 0-indexed
-	netdevIfaceField = 0
-	netdevRecvField  = 1
-	netdevTrnsField  = 9
-	netdevMaxField   = 9
+	netdevIfaceField   = 0
+	netdevCounterField = 1
+	netdevMaxField     = netdevCounterField + int(NumCounters) - 1
 
-	netdevMaxLineSize   = 1024
-	ifaceListInitialCap = 128
+	netdevMaxLineSize = 1024
 )
 
-var (
-	netdevName = "${HOST_PROC:-/proc}/net/dev"
-	netdevPath string
+const netdevName = hostProcName + "/net/dev"
+
+type NetDev struct {
+	ifaceMatcher MatchFunc
+	logger       *slog.Logger
+
+	ifaces []Iface
+
+	// IDs of the interfaces matched by the previous parse.
+	prevNames []string
+
+	scanBuf    []byte
+	file       *oslite.File
+	netdevPath string // See setHost.
+
+	// Directory of the link details of the interfaces (see Link),
+	// and the cached link of each matched interface.
+	linkDir string
+	links   map[string]*cachedLink
+
+	// How stacked interfaces are aggregated (see SetAggregation),
+	// the topology they are aggregated by, when it was read,
+	// whether an interface it doesn't know was matched since,
+	// and the matched interfaces that are collected.
+	aggregation   Aggregation
+	topology      *topology
+	topologyRead  time.Time
+	topologyStale bool
+	vlanConfig    string
+	collected     []Iface
+
+	// Whether the interfaces of every network namespace are collected (see SetAllNetns),
+	// and whether veths are paired with their peers (see SetPeers);
+	// the namespaces found under procDir, when they were found,
+	// whether one of them went away since, the namespace of netexp itself,
+	// the resolver of their containers (see SetContainers),
+	// and the interfaces of the namespaces by index.
+	allNetns   bool
+	peers      bool
+	netns      []Netns
+	netnsRead  time.Time
+	netnsStale bool
+	procDir    string
+	ownNetns   string
+	containers *container.Resolver
+	peerIndex  map[int][]peerRef
+}
+
+type MatchFunc func(ifaceName []byte) bool
+
+// Iface holds the traffic counters of a single network interface.
+type Iface struct {
+	Name  string
+	Netns string // Network namespace (see Netns.ID), only set when collecting every namespace.
+	// Container of the namespace, or of the namespace of the peer,
+	// only set with a resolver (see SetContainers).
+	Container container.Identity
+	Peer      Peer // Only set when pairing veths (see SetPeers).
+	Stats     Stats
+	Link      Link // Only set by Ifaces, and only for the interfaces of netexp's own namespace.
+}
+
+// ID returns the name of the interface, prefixed with its network namespace
+// and a slash if it has one, e.g. "4026532201/eth0".
+// Unlike the name, it identifies the interface across namespaces,
+// as interface names can't contain slashes.
+func (i *Iface) ID() string {
+	if i.Netns == "" {
+		return i.Name
+	}
+	return i.Netns + "/" + i.Name
+}
+
+// hasID reports whether id is the ID of i, without building it.
+func (i *Iface) hasID(id string) bool {
+	if i.Netns == "" {
+		return i.Name == id
+	}
+	netns, name, ok := strings.Cut(id, "/")
+	return ok && netns == i.Netns && name == i.Name
+}
+
+// SplitID splits an interface ID (see Iface.ID) into its network namespace and name.
+func SplitID(id string) (netns, name string) {
+	netns, name, ok := strings.Cut(id, "/")
+	if !ok {
+		return "", id
+	}
+	return netns, name
+}
+
+// Stats holds every counter of a network interface, indexed by Counter.
+type Stats [NumCounters]int64
+
+// Add adds the counters of o to s.
+func (s *Stats) Add(o *Stats) {
+	for i := range s {
+		s[i] += o[i]
+	}
+}
 
-	ifaceListDelim = []byte(", ")
+// Counter identifies one of the columns of /proc/net/dev.
+// The counters are in the same order as the columns.
+type Counter int
+
+const (
+	RecvBytes Counter = iota
+	RecvPackets
+	RecvErrs
+	RecvDrop
+	RecvFifo
+	RecvFrame
+	RecvCompressed
+	RecvMulticast
+	TrnsBytes
+	TrnsPackets
+	TrnsErrs
+	TrnsDrop
+	TrnsFifo
+	TrnsColls
+	TrnsCarrier
+	TrnsCompressed
+
+	NumCounters
 )
 
+var counterKinds = [NumCounters]string{
+	RecvBytes:      "bytes",
+	RecvPackets:    "packets",
+	RecvErrs:       "errs",
+	RecvDrop:       "drop",
+	RecvFifo:       "fifo",
+	RecvFrame:      "frame",
+	RecvCompressed: "compressed",
+	RecvMulticast:  "multicast",
+	TrnsBytes:      "bytes",
+	TrnsPackets:    "packets",
+	TrnsErrs:       "errs",
+	TrnsDrop:       "drop",
+	TrnsFifo:       "fifo",
+	TrnsColls:      "colls",
+	TrnsCarrier:    "carrier",
+	TrnsCompressed: "compressed",
+}
+
+var counterNames [NumCounters]string
+
 func init() {
-	hostProc := os.Getenv("HOST_PROC")
-	if hostProc == "" {
-		hostProc = "/proc"
+	for c := range NumCounters {
+		counterNames[c] = c.Direction() + "_" + c.Kind()
 	}
-	netdevPath = hostProc + "/net/dev"
 }
 
-type NetDev struct {
-	ifaceMatcher MatchFunc
-	logger       LogFunc
+// String returns the name of c, e.g. "recv_bytes".
+func (c Counter) String() string {
+	if c < 0 || c >= NumCounters {
+		return fmt.Sprintf("Counter(%d)", int(c))
+	}
+	return counterNames[c]
+}
 
-	ifaceList     []byte
-	prevIfaceList []byte
+// Direction returns "recv" or "trns".
+func (c Counter) Direction() string {
+	if c < TrnsBytes {
+		return "recv"
+	}
+	return "trns"
+}
 
-	scanBuf []byte
-	file    *oslite.File
+// Kind returns the name of c without the direction, e.g. "bytes".
+func (c Counter) Kind() string {
+	return counterKinds[c]
 }
 
-type (
-	MatchFunc func(ifaceName []byte) bool
-	LogFunc   func(func(io.Writer))
-)
+// ParseCounter returns the counter with the given name, e.g. "recv_bytes".
+func ParseCounter(name string) (Counter, error) {
+	for c := range NumCounters {
+		if counterNames[c] == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown counter %q", name)
+}
 
-func New(ifaceMatcher MatchFunc, logger LogFunc) *NetDev {
+// New returns a NetDev that reads the interfaces matched by ifaceMatcher.
+// If logger is not nil, changes to the set of matched interfaces are logged to it.
+func New(ifaceMatcher MatchFunc, logger *slog.Logger) *NetDev {
 	d := &NetDev{
 		ifaceMatcher: ifaceMatcher,
 		logger:       logger,
 		scanBuf:      make([]byte, netdevMaxLineSize),
 		file:         new(oslite.File),
 	}
-	if d.logger != nil {
-		d.ifaceList = make([]byte, 0, ifaceListInitialCap)
-		d.prevIfaceList = make([]byte, 0, ifaceListInitialCap)
-	}
+	d.setHost(hostProc, hostSys)
 	return d
 }
 
+// setHost makes d read the procfs and the sysfs mounted on procDir and sysDir.
+func (d *NetDev) setHost(procDir, sysDir string) {
+	d.procDir = procDir
+	d.netdevPath = procDir + "/net/dev"
+	d.vlanConfig = procDir + "/net/vlan/config"
+	d.linkDir = sysDir + "/class/net"
+}
+
+// SetAggregation sets which of the matched interfaces that are stacked on each other are collected.
+// Unless it is AggregateAll, the topology of the interfaces is read (see readTopology)
+// at most once a minute, or when an interface it doesn't know is matched,
+// unless the interface was missing from the topology already.
+func (d *NetDev) SetAggregation(a Aggregation) {
+	d.aggregation = a
+	d.topology = nil
+}
+
+// Traffic returns the sum of the counters of all matched interfaces.
 func (d *NetDev) Traffic() (recv, trns int64, err error) {
-	err = d.file.Open(netdevPath)
+	err = d.refreshTopology(time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+	err = d.file.Open(d.netdevPath)
 	if err != nil {
 		return 0, 0, fmt.Errorf("could not open file %q: %w", netdevName, err)
 	}
@@ -88,13 +265,93 @@ func (d *NetDev) Traffic() (recv, trns int64, err error) {
 	return d.traffic(d.file)
 }
 
+// Ifaces returns the counters and link details of each matched interface,
+// in the order they appear in /proc/net/dev.
+// Link details are read from /sys/class/net at most once a minute,
+// and veths are paired with their peers (see SetPeers).
+// The returned slice is only valid until the next call to Ifaces, Traffic,
+// or Read of a Source of d.
+func (d *NetDev) Ifaces() ([]Iface, error) {
+	return d.read(time.Now(), d.parseProcfs)
+}
+
+// read returns the matched interfaces that parse returns,
+// with their link details and peers.
+func (d *NetDev) read(now time.Time, parse func(now time.Time) ([]Iface, error)) ([]Iface, error) {
+	err := d.refreshTopology(now)
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := parse(now)
+	if err != nil {
+		return nil, err
+	}
+	d.readLinks(ifaces, now)
+	if d.peers {
+		err = d.pairPeers(ifaces, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ifaces, nil
+}
+
+// parseProcfs parses the /proc/net/dev of every network namespace with SetAllNetns,
+// or else the one of netexp's own.
+func (d *NetDev) parseProcfs(now time.Time) ([]Iface, error) {
+	if d.allNetns {
+		return d.parseNetns(now)
+	}
+	return d.parseFile()
+}
+
+// parseFile parses /proc/net/dev.
+func (d *NetDev) parseFile() ([]Iface, error) {
+	err := d.file.Open(d.netdevPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %q: %w", netdevName, err)
+	}
+	defer d.file.Close()
+	return d.parse(d.file)
+}
+
 func (d *NetDev) traffic(r io.Reader) (recv, trns int64, err error) {
+	ifaces, err := d.parse(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	recv, trns = sumTraffic(ifaces)
+	return recv, trns, nil
+}
+
+func sumTraffic(ifaces []Iface) (recv, trns int64) {
+	for _, iface := range ifaces {
+		recv += iface.Stats[RecvBytes]
+		trns += iface.Stats[TrnsBytes]
+	}
+	return recv, trns
+}
+
+func (d *NetDev) parse(r io.Reader) ([]Iface, error) {
+	d.ifaces = d.ifaces[:0]
+	err := d.scan(r, "", netdevName)
+	if err != nil {
+		return nil, err
+	}
+	return d.matched(), nil
+}
+
+// scan appends the matched interfaces of r, which has the content of file name,
+// to d.ifaces as interfaces of the given network namespace.
+func (d *NetDev) scan(r io.Reader, netns, name string) error {
 
 	scanner := bufio.NewScanner(r)
 	scanner.Buffer(d.scanBuf, cap(d.scanBuf))
 
 	lineNum := 0
 
+	var err error
+
 	for scanner.Scan() {
 
 		lineNum++
@@ -106,55 +363,104 @@ func (d *NetDev) traffic(r io.Reader) (recv, trns int64, err error) {
 
 		fields := make([][]byte, netdevMaxField+1)
 		n := readFields(line, fields)
-		fields = fields[:n]
+		if n != len(fields) {
+			return fmt.Errorf("line %d of %q has %d fields, want %d", lineNum, name, n, len(fields))
+		}
 
 		iface := fields[netdevIfaceField]
 		iface = bytes.TrimRight(iface, ":")
-		recvText := fields[netdevRecvField]
-		trnsText := fields[netdevTrnsField]
 
 		if !d.ifaceMatcher(iface) {
 			continue
 		}
 
-		if d.logger != nil {
-			d.ifaceList = append(d.ifaceList, iface...)
-			d.ifaceList = append(d.ifaceList, ifaceListDelim...)
+		var stats Stats
+		for c, text := range fields[netdevCounterField:] {
+			stats[c], err = strconv.ParseInt(string(text), 10, 64)
+			if err != nil {
+				return fmt.Errorf("could not parse %s number: %w", Counter(c), err)
+			}
 		}
 
-		x, err := strconv.ParseInt(string(recvText), 10, 64)
-		if err != nil {
-			return 0, 0, fmt.Errorf("could not parse recv number: %w", err)
-		}
-		recv += x
+		d.ifaces = append(d.ifaces, Iface{
+			Name:  d.ifaceName(iface),
+			Netns: netns,
+			Stats: stats,
+		})
+	}
 
-		x, err = strconv.ParseInt(string(trnsText), 10, 64)
-		if err != nil {
-			return 0, 0, fmt.Errorf("could not parse trnx number: %w", err)
-		}
-		trns += x
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("could not scan file %q: %w", name, err)
 	}
 
+	return nil
+}
+
+// matched returns the interfaces of d.ifaces that are collected,
+// logging the changes to them.
+func (d *NetDev) matched() []Iface {
+	ifaces := d.unstacked()
 	if d.logger != nil {
-		if !bytes.Equal(d.ifaceList, d.prevIfaceList) {
-			d.logger(func(w io.Writer) {
-				fmt.Fprintf(w,
-					"matched interfaces: %s",
-					bytes.TrimSuffix(d.ifaceList, ifaceListDelim),
-				)
-			})
+		d.logChanges(ifaces)
+	}
+	return ifaces
+}
+
+// logChanges logs the interfaces that were added or removed since the previous parse.
+// It doesn't allocate when the set of matched interfaces is unchanged.
+func (d *NetDev) logChanges(ifaces []Iface) {
+
+	unchanged := len(ifaces) == len(d.prevNames)
+	for i := 0; unchanged && i < len(ifaces); i++ {
+		unchanged = ifaces[i].hasID(d.prevNames[i])
+	}
+	if unchanged {
+		return
+	}
+
+	var added, removed []string
+	for _, iface := range ifaces {
+		if !slices.Contains(d.prevNames, iface.ID()) {
+			added = append(added, iface.ID())
+		}
+	}
+	for _, name := range d.prevNames {
+		i := slices.IndexFunc(ifaces, func(iface Iface) bool {
+			return iface.hasID(name)
+		})
+		if i < 0 {
+			removed = append(removed, name)
 		}
-		tmp := d.prevIfaceList
-		d.prevIfaceList = d.ifaceList
-		d.ifaceList = tmp[:0]
 	}
 
-	err = scanner.Err()
-	if err != nil {
-		return 0, 0, fmt.Errorf("could not scan file %q: %w", netdevName, err)
+	d.prevNames = d.prevNames[:0]
+	for _, iface := range ifaces {
+		d.prevNames = append(d.prevNames, iface.ID())
 	}
 
-	return recv, trns, nil
+	if len(added) > 0 || len(removed) > 0 {
+		d.logger.Info(
+			"matched interfaces changed",
+			"added", added,
+			"removed", removed,
+			"matched", d.prevNames,
+		)
+	}
+}
+
+// ifaceName returns name as a string,
+// reusing the string from the previous parse at the same position
+// so that a stable set of interfaces causes no allocations.
+func (d *NetDev) ifaceName(name []byte) string {
+	i := len(d.ifaces)
+	if i < cap(d.ifaces) {
+		prev := d.ifaces[:i+1][i].Name
+		if prev == string(name) {
+			return prev
+		}
+	}
+	return string(name)
 }
 
 // Of course bytes.Fields allocates,
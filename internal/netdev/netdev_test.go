@@ -4,8 +4,10 @@
 package netdev
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 	"regexp"
 	"strings"
 	"testing"
@@ -16,7 +18,7 @@ import (
 const data = `Inter-|   Receive                                                |  Transmit
  face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
     lo: 4097124    99393    0    0    0     0          0         0    673328  99393    0    0    0     0       0          0
-  eth0: %d          2497    0    0    0     0          0         0    %d       5772    0    0    0     0       0          0
+  eth0: %d          2497    1    2    3     4          5         6    %d       5772    7    8    9    10      11         12
 enp3s0: %d         92179    0    0    0     0          0         0    %d       8210    0    0    0     0       0          0
  wlan0: %d        169069    0    0    0     0          0         0    %d      98492    0    0    0     0       0          0
 docker0:  314460     645    0    0    0     0          0         0   746608     784    0    0    0     0       0          0
@@ -52,6 +54,82 @@ func TestTraffic(t *testing.T) {
 	}
 }
 
+func TestIfaces(t *testing.T) {
+	d := New(ifaceRegexp.Match, nil)
+	want := []Iface{
+		{Name: "eth0", Stats: Stats{
+			recv1, 2497, 1, 2, 3, 4, 5, 6,
+			trns1, 5772, 7, 8, 9, 10, 11, 12,
+		}},
+		{Name: "enp3s0", Stats: Stats{
+			RecvBytes: recv2, RecvPackets: 92179,
+			TrnsBytes: trns2, TrnsPackets: 8210,
+		}},
+		{Name: "wlan0", Stats: Stats{
+			RecvBytes: recv3, RecvPackets: 169069,
+			TrnsBytes: trns3, TrnsPackets: 98492,
+		}},
+	}
+	for range 3 {
+		r.Seek(0, io.SeekStart)
+		ifaces, err := d.parse(r)
+		assert.NoError(t, err)
+		assert.Equal(t, want, ifaces)
+	}
+}
+
+func TestIfaces_Log(t *testing.T) {
+
+	logs := new(bytes.Buffer)
+	logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	d := New(ifaceRegexp.Match, logger)
+
+	parse := func(s string) {
+		t.Helper()
+		_, err := d.parse(strings.NewReader("header\nheader\n" + s))
+		assert.NoError(t, err)
+	}
+	line := func(iface string) string {
+		return iface + ": 1 0 0 0 0 0 0 0 2 0 0 0 0 0 0 0\n"
+	}
+
+	parse(line("eth0") + line("wlan0"))
+	parse(line("eth0") + line("wlan0"))
+	parse(line("eth0") + line("eth1"))
+	parse("")
+
+	want := `{"level":"INFO","msg":"matched interfaces changed","added":["eth0","wlan0"],"removed":null,"matched":["eth0","wlan0"]}
+{"level":"INFO","msg":"matched interfaces changed","added":["eth1"],"removed":["wlan0"],"matched":["eth0","eth1"]}
+{"level":"INFO","msg":"matched interfaces changed","added":null,"removed":["eth0","eth1"],"matched":[]}
+`
+	assert.Equal(t, want, logs.String())
+}
+
+func TestIfaces_ShortLine(t *testing.T) {
+	d := New(ifaceRegexp.Match, nil)
+	_, err := d.parse(strings.NewReader("header\nheader\n  eth0: 1 2 3\n"))
+	assert.Error(t, err)
+}
+
+func TestCounter(t *testing.T) {
+	for c := range NumCounters {
+		got, err := ParseCounter(c.String())
+		assert.NoError(t, err)
+		assert.Equal(t, c, got)
+	}
+	assert.Equal(t, "recv_bytes", RecvBytes.String())
+	assert.Equal(t, "trns_carrier", TrnsCarrier.String())
+	_, err := ParseCounter("recv_colls")
+	assert.Error(t, err)
+}
+
 func TestTraffic_NoAlloc(t *testing.T) {
 	d := New(ifaceRegexp.Match, nil)
 	wantAllocs := float64(0)
@@ -71,6 +149,16 @@ func BenchmarkTraffic(b *testing.B) {
 	}
 }
 
+func TestIfaces_LogNoAlloc(t *testing.T) {
+	d := New(ifaceRegexp.Match, slog.New(slog.DiscardHandler))
+	wantAllocs := float64(0)
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Seek(0, io.SeekStart)
+		d.traffic(r)
+	})
+	assert.Equal(t, wantAllocs, allocs)
+}
+
 func BenchmarkTrafficSystem(b *testing.B) {
 	d := New(ifaceRegexp.Match, nil)
 	for b.Loop() {
@@ -0,0 +1,266 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// Backend selects the Source that reads the counters of the interfaces (see NewSource).
+type Backend int
+
+const (
+	// BackendProcfs parses /proc/net/dev (see ProcfsSource).
+	BackendProcfs Backend = iota
+	// BackendNetlink dumps the IFLA_STATS64 of every link
+	// with a single RTM_GETLINK request over rtnetlink,
+	// which is cheaper than parsing text, the more so with many interfaces.
+	// It only sees netexp's own network namespace (see NetlinkSource).
+	BackendNetlink
+)
+
+var backendNames = []string{
+	BackendProcfs:  "procfs",
+	BackendNetlink: "netlink",
+}
+
+func (b Backend) String() string {
+	if int(b) < len(backendNames) {
+		return backendNames[b]
+	}
+	return fmt.Sprintf("Backend(%d)", int(b))
+}
+
+// ParseBackend returns the Backend named s (procfs or netlink).
+func ParseBackend(s string) (Backend, error) {
+	i := slices.Index(backendNames, s)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown source %q", s)
+	}
+	return Backend(i), nil
+}
+
+// Netlink message layout, from linux/netlink.h and linux/rtnetlink.h.
+const (
+	nlmsgHdrLen  = 16 // struct nlmsghdr
+	ifinfomsgLen = 16 // struct ifinfomsg
+	rtattrHdrLen = 4  // struct rtattr
+
+	nlmsgDone  = 3
+	nlmsgError = 2
+	rtmNewLink = 16
+	rtmGetLink = 18
+
+	nlmFRequest = 0x1
+	nlmFDump    = 0x300
+
+	iflaIfname  = 3
+	iflaStats64 = 23
+	nlaTypeMask = 0x3fff // Without the nested and byte order flags.
+
+	// Size of the receive buffer, which has to hold the largest message of a dump,
+	// as the rest of a message that doesn't fit is lost.
+	// The kernel sends at most 32KiB at once, or a page if that's larger.
+	netlinkBufSize = 64 << 10
+)
+
+// Fields of struct rtnl_link_stats64, which are all 64-bit.
+const (
+	rxPackets = iota
+	txPackets
+	rxBytes
+	txBytes
+	rxErrors
+	txErrors
+	rxDropped
+	txDropped
+	multicast
+	collisions
+	rxLengthErrors
+	rxOverErrors
+	rxCRCErrors
+	rxFrameErrors
+	rxFIFOErrors
+	rxMissedErrors
+	txAbortedErrors
+	txCarrierErrors
+	txFIFOErrors
+	txHeartbeatErrors
+	txWindowErrors
+	rxCompressed
+	txCompressed
+
+	numLinkStats64
+)
+
+var errMalformedNetlink = errors.New("malformed netlink message")
+
+// NetlinkSource is the Source of the interfaces of a NetDev
+// that reads them with an rtnetlink dump (see BackendNetlink).
+// It only sees netexp's own network namespace, whatever NetDev.SetAllNetns.
+type NetlinkSource struct {
+	d    *NetDev
+	conn *netlinkConn
+}
+
+// NewNetlinkSource returns a NetlinkSource of d.
+// Its socket is opened on the first read.
+func NewNetlinkSource(d *NetDev) *NetlinkSource {
+	return &NetlinkSource{d: d}
+}
+
+// Read returns the counters and link details of each matched interface (see NetDev.Ifaces),
+// in the order of the netlink dump, as of when they were read.
+func (s *NetlinkSource) Read() (Snapshot, error) {
+	return s.d.snapshot(s.parse)
+}
+
+// Close releases the netlink socket of s, if it has one.
+// s opens a new one if it is read again.
+func (s *NetlinkSource) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.close()
+	s.conn = nil
+	return err
+}
+
+// parse reads the interfaces with an rtnetlink dump.
+// It doesn't allocate when the set of matched interfaces is unchanged.
+func (s *NetlinkSource) parse(time.Time) ([]Iface, error) {
+	if s.conn == nil {
+		c, err := openNetlink()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	d := s.d
+	d.ifaces = d.ifaces[:0]
+	err := s.conn.dump(d.addLink)
+	if err != nil {
+		// Start over with a new socket rather than sort out what is left of the dump.
+		s.Close()
+		return nil, err
+	}
+	return d.matched(), nil
+}
+
+// addLink appends the named interface to d.ifaces if it is matched.
+func (d *NetDev) addLink(name []byte, stats Stats) {
+	if d.ifaceMatcher(name) {
+		d.ifaces = append(d.ifaces, Iface{
+			Name:  d.ifaceName(name),
+			Stats: stats,
+		})
+	}
+}
+
+// newDumpRequest writes an RTM_GETLINK dump request with sequence number seq to req.
+func newDumpRequest(req *[nlmsgHdrLen + ifinfomsgLen]byte, seq uint32) {
+	*req = [nlmsgHdrLen + ifinfomsgLen]byte{}
+	ne := binary.NativeEndian
+	ne.PutUint32(req[0:], uint32(len(req)))
+	ne.PutUint16(req[4:], rtmGetLink)
+	ne.PutUint16(req[6:], nlmFRequest|nlmFDump)
+	ne.PutUint32(req[8:], seq)
+	// The ifinfomsg is left zero, for every link of every address family.
+}
+
+// parseNetlinkMessages calls fn with the name and counters of each link
+// in b, the messages received in answer to the dump request seq,
+// and reports whether they end the dump.
+// Messages of other requests, as left over from a dump that failed, are skipped.
+func parseNetlinkMessages(b []byte, seq uint32, fn func(name []byte, stats Stats)) (done bool, err error) {
+	ne := binary.NativeEndian
+	for len(b) >= nlmsgHdrLen {
+		n := int(ne.Uint32(b[0:]))
+		typ := ne.Uint16(b[4:])
+		msgSeq := ne.Uint32(b[8:])
+		if n < nlmsgHdrLen || n > len(b) {
+			return false, errMalformedNetlink
+		}
+		msg := b[nlmsgHdrLen:n]
+		b = b[min(align4(n), len(b)):]
+		if msgSeq != seq {
+			continue
+		}
+		switch typ {
+		case nlmsgDone:
+			return true, nil
+		case nlmsgError:
+			if len(msg) < 4 {
+				return false, errMalformedNetlink
+			}
+			errno := -int32(ne.Uint32(msg))
+			return false, fmt.Errorf("netlink dump failed: %w", syscall.Errno(errno))
+		case rtmNewLink:
+			parseLink(msg, fn)
+		}
+	}
+	return false, nil
+}
+
+// parseLink calls fn with the name and counters of the link of an RTM_NEWLINK message,
+// unless it doesn't have both.
+func parseLink(msg []byte, fn func(name []byte, stats Stats)) {
+	if len(msg) < ifinfomsgLen {
+		return
+	}
+	ne := binary.NativeEndian
+	var name, raw []byte
+	attrs := msg[ifinfomsgLen:]
+	for len(attrs) >= rtattrHdrLen {
+		n := int(ne.Uint16(attrs[0:]))
+		typ := ne.Uint16(attrs[2:]) & nlaTypeMask
+		if n < rtattrHdrLen || n > len(attrs) {
+			return
+		}
+		switch typ {
+		case iflaIfname:
+			name = bytes.TrimRight(attrs[rtattrHdrLen:n], "\x00")
+		case iflaStats64:
+			raw = attrs[rtattrHdrLen:n]
+		}
+		attrs = attrs[min(align4(n), len(attrs)):]
+	}
+	if len(name) == 0 || len(raw) < numLinkStats64*8 {
+		return
+	}
+	var s [numLinkStats64]int64
+	for i := range s {
+		s[i] = int64(ne.Uint64(raw[i*8:]))
+	}
+	// The same sums as the columns of /proc/net/dev, from dev_seq_printf_stats.
+	stats := Stats{
+		RecvBytes:      s[rxBytes],
+		RecvPackets:    s[rxPackets],
+		RecvErrs:       s[rxErrors],
+		RecvDrop:       s[rxDropped] + s[rxMissedErrors],
+		RecvFifo:       s[rxFIFOErrors],
+		RecvFrame:      s[rxLengthErrors] + s[rxOverErrors] + s[rxCRCErrors] + s[rxFrameErrors],
+		RecvCompressed: s[rxCompressed],
+		RecvMulticast:  s[multicast],
+		TrnsBytes:      s[txBytes],
+		TrnsPackets:    s[txPackets],
+		TrnsErrs:       s[txErrors],
+		TrnsDrop:       s[txDropped],
+		TrnsFifo:       s[txFIFOErrors],
+		TrnsColls:      s[collisions],
+		TrnsCarrier:    s[txCarrierErrors] + s[txAbortedErrors] + s[txWindowErrors] + s[txHeartbeatErrors],
+		TrnsCompressed: s[txCompressed],
+	}
+	fn(name, stats)
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
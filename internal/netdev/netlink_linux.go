@@ -0,0 +1,64 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// netlinkConn is an rtnetlink socket that dumps the statistics of every link.
+type netlinkConn struct {
+	fd     int
+	seq    uint32
+	kernel syscall.SockaddrNetlink
+	req    [nlmsgHdrLen + ifinfomsgLen]byte
+	buf    []byte
+}
+
+func openNetlink() (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("could not open netlink socket: %w", err)
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not bind netlink socket: %w", err)
+	}
+	return &netlinkConn{
+		fd:     fd,
+		kernel: syscall.SockaddrNetlink{Family: syscall.AF_NETLINK},
+		buf:    make([]byte, netlinkBufSize),
+	}, nil
+}
+
+func (c *netlinkConn) close() error {
+	return syscall.Close(c.fd)
+}
+
+// dump calls fn with the name and counters of every link.
+func (c *netlinkConn) dump(fn func(name []byte, stats Stats)) error {
+	c.seq++
+	newDumpRequest(&c.req, c.seq)
+	err := syscall.Sendto(c.fd, c.req[:], 0, &c.kernel)
+	if err != nil {
+		return fmt.Errorf("could not send netlink request: %w", err)
+	}
+	for {
+		// Unlike Recvfrom, Read doesn't allocate the address of the sender.
+		n, err := syscall.Read(c.fd, c.buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not receive netlink messages: %w", err)
+		}
+		done, err := parseNetlinkMessages(c.buf[:n], c.seq, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+}
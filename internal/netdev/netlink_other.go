@@ -0,0 +1,22 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+//go:build !linux
+
+package netdev
+
+import "errors"
+
+type netlinkConn struct{}
+
+func openNetlink() (*netlinkConn, error) {
+	return nil, errors.New("netlink is only supported on Linux")
+}
+
+func (c *netlinkConn) close() error {
+	return nil
+}
+
+func (c *netlinkConn) dump(fn func(name []byte, stats Stats)) error {
+	return errors.New("netlink is only supported on Linux")
+}
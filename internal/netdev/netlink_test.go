@@ -0,0 +1,180 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSeq = 7
+
+// netlinkMessage returns a netlink message of type typ and sequence number seq with payload.
+func netlinkMessage(typ uint16, seq uint32, payload []byte) []byte {
+	ne := binary.NativeEndian
+	n := nlmsgHdrLen + len(payload)
+	msg := make([]byte, align4(n))
+	ne.PutUint32(msg[0:], uint32(n))
+	ne.PutUint16(msg[4:], typ)
+	ne.PutUint16(msg[6:], 0x2) // NLM_F_MULTI
+	ne.PutUint32(msg[8:], seq)
+	copy(msg[nlmsgHdrLen:], payload)
+	return msg
+}
+
+// rtattr returns a route attribute of type typ.
+func rtattr(typ uint16, data []byte) []byte {
+	ne := binary.NativeEndian
+	n := rtattrHdrLen + len(data)
+	attr := make([]byte, align4(n))
+	ne.PutUint16(attr[0:], uint16(n))
+	ne.PutUint16(attr[2:], typ)
+	copy(attr[rtattrHdrLen:], data)
+	return attr
+}
+
+// newLinkMessage returns an RTM_NEWLINK message of a link whose rtnl_link_stats64 fields are
+// their index plus base.
+func newLinkMessage(seq uint32, name string, base uint64) []byte {
+	stats := make([]byte, numLinkStats64*8+16) // Newer kernels have more fields.
+	for i := range numLinkStats64 {
+		binary.NativeEndian.PutUint64(stats[i*8:], base+uint64(i))
+	}
+	payload := make([]byte, ifinfomsgLen)
+	payload = append(payload, rtattr(iflaIfname, append([]byte(name), 0))...)
+	payload = append(payload, rtattr(4, []byte{0xdc, 0x05, 0, 0})...) // IFLA_MTU
+	payload = append(payload, rtattr(iflaStats64, stats)...)
+	return netlinkMessage(rtmNewLink, seq, payload)
+}
+
+// wantLinkStats returns the Stats of a link of newLinkMessage.
+func wantLinkStats(base int64) Stats {
+	f := func(i int) int64 { return base + int64(i) }
+	return Stats{
+		RecvBytes:      f(rxBytes),
+		RecvPackets:    f(rxPackets),
+		RecvErrs:       f(rxErrors),
+		RecvDrop:       f(rxDropped) + f(rxMissedErrors),
+		RecvFifo:       f(rxFIFOErrors),
+		RecvFrame:      f(rxLengthErrors) + f(rxOverErrors) + f(rxCRCErrors) + f(rxFrameErrors),
+		RecvCompressed: f(rxCompressed),
+		RecvMulticast:  f(multicast),
+		TrnsBytes:      f(txBytes),
+		TrnsPackets:    f(txPackets),
+		TrnsErrs:       f(txErrors),
+		TrnsDrop:       f(txDropped),
+		TrnsFifo:       f(txFIFOErrors),
+		TrnsColls:      f(collisions),
+		TrnsCarrier:    f(txCarrierErrors) + f(txAbortedErrors) + f(txWindowErrors) + f(txHeartbeatErrors),
+		TrnsCompressed: f(txCompressed),
+	}
+}
+
+func concat(msgs ...[]byte) []byte {
+	var b []byte
+	for _, msg := range msgs {
+		b = append(b, msg...)
+	}
+	return b
+}
+
+func TestParseNetlinkMessages(t *testing.T) {
+	d := New(ifaceRegexp.Match, nil)
+	b := concat(
+		newLinkMessage(testSeq, "lo", 0),
+		newLinkMessage(testSeq-1, "eth1", 0), // Left over from a previous dump.
+		newLinkMessage(testSeq, "eth0", 1000),
+		netlinkMessage(rtmNewLink, testSeq, make([]byte, ifinfomsgLen)), // Without attributes.
+		newLinkMessage(testSeq, "wlan0", 2000),
+	)
+	done, err := parseNetlinkMessages(b, testSeq, d.addLink)
+	require.NoError(t, err)
+	assert.False(t, done)
+
+	done, err = parseNetlinkMessages(netlinkMessage(nlmsgDone, testSeq, make([]byte, 4)), testSeq, d.addLink)
+	require.NoError(t, err)
+	assert.True(t, done)
+
+	assert.Equal(t, []Iface{
+		{Name: "eth0", Stats: wantLinkStats(1000)},
+		{Name: "wlan0", Stats: wantLinkStats(2000)},
+	}, d.matched())
+}
+
+func TestParseNetlinkMessages_Error(t *testing.T) {
+	errMsg := make([]byte, 4+nlmsgHdrLen)
+	errno := -int32(syscall.EBUSY)
+	binary.NativeEndian.PutUint32(errMsg, uint32(errno))
+	_, err := parseNetlinkMessages(netlinkMessage(nlmsgError, testSeq, errMsg), testSeq, nil)
+	assert.ErrorIs(t, err, syscall.EBUSY)
+
+	msg := newLinkMessage(testSeq, "eth0", 0)
+	_, err = parseNetlinkMessages(msg[:len(msg)-8], testSeq, nil)
+	assert.ErrorIs(t, err, errMalformedNetlink)
+}
+
+func TestParseNetlinkMessages_NoAlloc(t *testing.T) {
+	d := New(ifaceRegexp.Match, slog.New(slog.DiscardHandler))
+	b := concat(
+		newLinkMessage(testSeq, "lo", 0),
+		newLinkMessage(testSeq, "eth0", 1000),
+		newLinkMessage(testSeq, "wlan0", 2000),
+		netlinkMessage(nlmsgDone, testSeq, make([]byte, 4)),
+	)
+	addLink := d.addLink
+	wantAllocs := float64(0)
+	allocs := testing.AllocsPerRun(100, func() {
+		d.ifaces = d.ifaces[:0]
+		parseNetlinkMessages(b, testSeq, addLink)
+		d.matched()
+	})
+	assert.Equal(t, wantAllocs, allocs)
+}
+
+func TestNetlinkSource(t *testing.T) {
+	s := NewNetlinkSource(New(func([]byte) bool { return true }, nil))
+	defer s.Close()
+	snap, err := s.Read()
+	if err != nil {
+		t.Skipf("netlink is not available: %v", err)
+	}
+	// Every network namespace has a loopback interface.
+	assert.True(t, slices.ContainsFunc(snap.Ifaces, func(iface Iface) bool { return iface.Name == "lo" }))
+
+	// The socket is reused.
+	conn := s.conn
+	_, err = s.Read()
+	assert.NoError(t, err)
+	assert.Same(t, conn, s.conn)
+
+	require.NoError(t, s.Close())
+	assert.Nil(t, s.conn)
+}
+
+func TestParseBackend(t *testing.T) {
+	for _, b := range []Backend{BackendProcfs, BackendNetlink} {
+		got, err := ParseBackend(b.String())
+		assert.NoError(t, err)
+		assert.Equal(t, b, got)
+	}
+	_, err := ParseBackend("sysfs")
+	assert.Error(t, err)
+}
+
+func BenchmarkReadNetlink(b *testing.B) {
+	s := NewNetlinkSource(New(ifaceRegexp.Match, nil))
+	defer s.Close()
+	if _, err := s.Read(); err != nil {
+		b.Skipf("netlink is not available: %v", err)
+	}
+	for b.Loop() {
+		s.Read()
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/layer8co/netexp/internal/container"
+)
+
+// How long the network namespaces found are used for before looking for them again.
+const netnsRefresh = 10 * time.Second
+
+// Netns is a network namespace, and the process through which its interfaces are read.
+type Netns struct {
+	ID  string // Inode number of the namespace, e.g. "4026532201".
+	PID int    // Lowest PID of the processes in the namespace.
+
+	// Container of the process, only set by NetDev with a resolver (see SetContainers).
+	Container container.Identity
+
+	// Path and display name of the /proc/<pid>/net/dev of the process.
+	path, name string
+}
+
+// readNetns finds the network namespaces of the processes in procDir (/proc),
+// by the inode of their /proc/<pid>/ns/net, sorted by PID.
+// Processes that can't be looked into, as without CAP_SYS_PTRACE, are left out.
+func readNetns(procDir string) ([]Netns, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read network namespaces from %q: %w", hostProcName, err)
+	}
+	var all []Netns
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		link, err := os.Readlink(filepath.Join(procDir, e.Name(), "ns", "net"))
+		if err != nil {
+			// The process exited, or we may not look into it.
+			continue
+		}
+		id, ok := parseNetnsLink(link)
+		if !ok {
+			continue
+		}
+		i := slices.IndexFunc(all, func(ns Netns) bool { return ns.ID == id })
+		if i < 0 {
+			all = append(all, Netns{ID: id, PID: pid})
+		} else if pid < all[i].PID {
+			all[i].PID = pid
+		}
+	}
+	slices.SortFunc(all, func(a, b Netns) int { return a.PID - b.PID })
+	for i := range all {
+		ns := &all[i]
+		pid := strconv.Itoa(ns.PID)
+		ns.path = filepath.Join(procDir, pid, "net", "dev")
+		ns.name = hostProcName + "/" + pid + "/net/dev"
+	}
+	return all, nil
+}
+
+// parseNetnsLink returns the inode number of a network namespace link, which looks like "net:[4026531992]".
+func parseNetnsLink(link string) (string, bool) {
+	id, ok := strings.CutPrefix(link, "net:[")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(id, "]")
+}
+
+// ownNetns returns the network namespace of netexp itself, or "" if it can't be read.
+func ownNetns() string {
+	link, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		return ""
+	}
+	id, _ := parseNetnsLink(link)
+	return id
+}
+
+// SetAllNetns sets whether the interfaces of every network namespace are collected,
+// instead of only the ones of the namespace that /proc/net/dev is read in.
+// The namespaces are found through the /proc/<pid>/ns/net of every process
+// at most every 10 seconds,
+// or as soon as the process through which one is read exits,
+// and the Netns of each interface is set.
+// Link details and the topology (see SetAggregation) are only read
+// for the interfaces of netexp's own namespace.
+func (d *NetDev) SetAllNetns(all bool) {
+	d.allNetns = all
+	d.netns = nil
+	if all && d.ownNetns == "" {
+		d.ownNetns = ownNetns()
+	}
+}
+
+// own reports whether iface is in netexp's own network namespace.
+func (d *NetDev) own(iface *Iface) bool {
+	return iface.Netns == "" || iface.Netns == d.ownNetns
+}
+
+// SetContainers sets the resolver of the container of each network namespace,
+// or nil to not resolve them, when collecting every namespace or pairing veths.
+// The container of a namespace is that of the process its interfaces are read through.
+func (d *NetDev) SetContainers(r *container.Resolver) {
+	d.containers = r
+	d.netns = nil
+}
+
+// resolveContainers sets the container of each of netns,
+// reusing the ones of the namespaces found before through the same process.
+func (d *NetDev) resolveContainers(netns []Netns) {
+	for i := range netns {
+		ns := &netns[i]
+		j := slices.IndexFunc(d.netns, func(prev Netns) bool {
+			return prev.ID == ns.ID && prev.PID == ns.PID
+		})
+		if j >= 0 {
+			ns.Container = d.netns[j].Container
+			continue
+		}
+		var err error
+		ns.Container, err = d.containers.Resolve(ns.PID)
+		if err != nil && d.logger != nil {
+			d.logger.Warn("could not resolve container of network namespace", "netns", ns.ID, "pid", ns.PID, "err", err)
+		}
+	}
+}
+
+// refreshNetns finds the network namespaces again if they are out of date.
+func (d *NetDev) refreshNetns(now time.Time) error {
+	if d.netns != nil && !d.netnsStale && now.Sub(d.netnsRead) < netnsRefresh {
+		return nil
+	}
+	netns, err := readNetns(d.procDir)
+	if err != nil {
+		return err
+	}
+	if d.containers != nil {
+		d.resolveContainers(netns)
+	}
+	d.netns = netns
+	d.netnsRead = now
+	d.netnsStale = false
+	if d.peers {
+		d.indexPeers()
+	}
+	return nil
+}
+
+// parseNetns reads the interfaces of every network namespace,
+// finding the namespaces again if they are out of date.
+func (d *NetDev) parseNetns(now time.Time) ([]Iface, error) {
+	err := d.refreshNetns(now)
+	if err != nil {
+		return nil, err
+	}
+	d.ifaces = d.ifaces[:0]
+	for i := range d.netns {
+		ns := &d.netns[i]
+		err := d.file.Open(ns.path)
+		if err != nil {
+			// The process exited; another one in the namespace,
+			// if it's still there, is looked for next time.
+			d.netnsStale = true
+			continue
+		}
+		n := len(d.ifaces)
+		err = d.scan(d.file, ns.ID, ns.name)
+		d.file.Close()
+		if err != nil {
+			return nil, err
+		}
+		for j := n; j < len(d.ifaces); j++ {
+			d.ifaces[j].Container = ns.Container
+		}
+	}
+	return d.matched(), nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/layer8co/netexp/internal/container"
+)
+
+const containerData = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     100     1    0    0    0     0          0         0      100       1    0    0    0     0       0          0
+  eth0:     %s      1    0    0    0     0          0         0      %s        1    0    0    0     0       0          0
+`
+
+func TestReadNetns(t *testing.T) {
+	h := newFakeHost(t)
+	h.processes(map[int]string{
+		1:   "4026531992",
+		2:   "4026531992",
+		300: "4026532201",
+		42:  "4026532201",
+		7:   "4026532300",
+	})
+	dir := h.path("proc")
+	netns, err := readNetns(dir)
+	require.NoError(t, err)
+	require.Len(t, netns, 3)
+	assert.Equal(t, "4026531992", netns[0].ID)
+	assert.Equal(t, 1, netns[0].PID)
+	assert.Equal(t, "4026532300", netns[1].ID)
+	assert.Equal(t, 7, netns[1].PID)
+	assert.Equal(t, "4026532201", netns[2].ID)
+	assert.Equal(t, 42, netns[2].PID)
+	assert.Equal(t, filepath.Join(dir, "42", "net", "dev"), netns[2].path)
+	assert.Equal(t, "${HOST_PROC:-/proc}/42/net/dev", netns[2].name)
+
+	_, err = readNetns(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestIfaces_AllNetns(t *testing.T) {
+	h := newFakeHost(t)
+	h.processes(map[int]string{
+		1:  "4026531992",
+		42: "4026532201",
+	})
+	d := h.newNetDev(ifaceRegexp.Match)
+	d.SetAllNetns(true)
+	d.ownNetns = "4026531992"
+	now := time.Unix(1700000000, 0)
+
+	ifaces, err := d.parseNetns(now)
+	require.NoError(t, err)
+	require.Len(t, ifaces, 2)
+	assert.Equal(t, "eth0", ifaces[0].Name)
+	assert.Equal(t, "4026531992", ifaces[0].Netns)
+	assert.Equal(t, int64(4026531992), ifaces[0].Stats[RecvBytes])
+	assert.Equal(t, "4026532201/eth0", ifaces[1].ID())
+	assert.Equal(t, int64(4026532201), ifaces[1].Stats[TrnsBytes])
+
+	// A process that exits is replaced by another one in its namespace.
+	h.remove("proc/42")
+	ifaces, err = d.parseNetns(now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, ifaces, 1)
+	h.process(43, "4026532201")
+	ifaces, err = d.parseNetns(now.Add(2 * time.Second))
+	require.NoError(t, err)
+	require.Len(t, ifaces, 2)
+	assert.Equal(t, "4026532201", ifaces[1].Netns)
+
+	// New namespaces are found after a while.
+	h.process(50, "4026532300")
+	ifaces, err = d.parseNetns(now.Add(3 * time.Second))
+	require.NoError(t, err)
+	assert.Len(t, ifaces, 2)
+	ifaces, err = d.parseNetns(now.Add(2*time.Second + netnsRefresh))
+	require.NoError(t, err)
+	assert.Len(t, ifaces, 3)
+}
+
+func TestIfaces_Containers(t *testing.T) {
+	h := newFakeHost(t)
+	h.processes(map[int]string{
+		1:  "4026531992",
+		42: "4026532201",
+	})
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	cgroup := "0::/system.slice/docker-" + id + ".scope\n"
+	h.write("proc/1/cgroup", "0::/init.scope\n")
+	h.write("proc/42/cgroup", cgroup)
+
+	d := h.newNetDev(ifaceRegexp.Match)
+	d.SetAllNetns(true)
+	d.SetContainers(container.NewResolver(h.path("proc"), nil))
+	ifaces, err := d.parseNetns(time.Unix(1700000000, 0))
+	require.NoError(t, err)
+	require.Len(t, ifaces, 2)
+	assert.True(t, ifaces[0].Container.IsZero())
+	assert.Equal(t, container.Identity{ContainerID: id}, ifaces[1].Container)
+}
+
+func TestIfaceID(t *testing.T) {
+	for _, iface := range []Iface{
+		{Name: "eth0"},
+		{Name: "eth0", Netns: "4026532201"},
+	} {
+		id := iface.ID()
+		assert.True(t, iface.hasID(id), id)
+		netns, name := SplitID(id)
+		assert.Equal(t, iface.Netns, netns)
+		assert.Equal(t, iface.Name, name)
+	}
+	iface := Iface{Name: "eth0", Netns: "4026532201"}
+	assert.False(t, iface.hasID("eth0"))
+	assert.False(t, iface.hasID("4026532201/eth1"))
+}
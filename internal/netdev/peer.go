@@ -0,0 +1,106 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Peer is the other end of a veth pair, in another network namespace.
+type Peer struct {
+	Netns string // See Netns.ID.
+	Name  string
+}
+
+// peerRef is an interface of one of NetDev.netns.
+type peerRef struct {
+	netns  int // Index in NetDev.netns.
+	name   string
+	ifLink int // See Link.IfLink.
+}
+
+// SetPeers sets whether the matched interfaces of netexp's own network namespace
+// that are linked to an interface of another namespace, like the host end
+// of the veth pair of a container, are paired with it.
+// The interfaces of each namespace are listed, with their index and iflink,
+// from the sysfs of a process in it, /proc/<pid>/root/sys/class/net,
+// when the namespaces are found (see SetAllNetns), and the Peer of an interface
+// is set if its iflink (see Link) is the index of a single one of them
+// that is linked back to it.
+func (d *NetDev) SetPeers(peers bool) {
+	d.peers = peers
+	d.netns = nil
+	if peers && d.ownNetns == "" {
+		d.ownNetns = ownNetns()
+	}
+}
+
+// indexPeers indexes the interfaces of d.netns by their index.
+// An index is often used in several namespaces, e.g. 1 for lo,
+// or the same for the eth0 of every pod on Kubernetes,
+// which pairPeers tells apart by their iflink.
+func (d *NetDev) indexPeers() {
+	if d.peerIndex == nil {
+		d.peerIndex = make(map[int][]peerRef)
+	}
+	clear(d.peerIndex)
+	for i := range d.netns {
+		dir := filepath.Join(d.procDir, strconv.Itoa(d.netns[i].PID), "root", "sys", "class", "net")
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			// The process may have exited, or have no sysfs.
+			continue
+		}
+		for _, e := range entries {
+			link, err := readLink(dir, e.Name())
+			if err != nil || link.IfIndex == 0 {
+				continue
+			}
+			d.peerIndex[link.IfIndex] = append(d.peerIndex[link.IfIndex], peerRef{
+				netns:  i,
+				name:   e.Name(),
+				ifLink: link.IfLink,
+			})
+		}
+	}
+}
+
+// pairPeers sets the peer of each of ifaces that is linked to a single interface
+// of another network namespace that is linked back to it,
+// and the container of that namespace.
+func (d *NetDev) pairPeers(ifaces []Iface, now time.Time) error {
+	err := d.refreshNetns(now)
+	if err != nil {
+		return err
+	}
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if !d.own(iface) || iface.Link.IfLink == 0 || iface.Link.IfLink == iface.Link.IfIndex {
+			continue
+		}
+		var peer *peerRef
+		for j, ref := range d.peerIndex[iface.Link.IfLink] {
+			if ref.ifLink != iface.Link.IfIndex || d.netns[ref.netns].ID == d.ownNetns {
+				// Another interface at that index, or a VLAN or macvlan of an interface of ours.
+				continue
+			}
+			if peer != nil {
+				// Ambiguous.
+				peer = nil
+				break
+			}
+			peer = &d.peerIndex[iface.Link.IfLink][j]
+		}
+		if peer == nil {
+			continue
+		}
+		ns := &d.netns[peer.netns]
+		iface.Peer = Peer{Netns: ns.ID, Name: peer.name}
+		iface.Container = ns.Container
+	}
+	return nil
+}
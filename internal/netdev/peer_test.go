@@ -0,0 +1,84 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const vethData = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+  eth0:     100     1    0    0    0     0          0         0      100       1    0    0    0     0       0          0
+eth0.100:   100     1    0    0    0     0          0         0      100       1    0    0    0     0       0          0
+veth1a2b3c: 200     1    0    0    0     0          0         0      200       1    0    0    0     0       0          0
+veth4d5e6f: 300     1    0    0    0     0          0         0      300       1    0    0    0     0       0          0
+veth7a8b9c: 400     1    0    0    0     0          0         0      400       1    0    0    0     0       0          0
+`
+
+func TestIfaces_Peers(t *testing.T) {
+	h := newFakeHost(t)
+	h.processes(map[int]string{
+		1:   "4026531992",
+		100: "4026532201",
+		200: "4026532300",
+		300: "4026532400",
+	})
+	// The host namespace, seen through the sysfs of netexp's own process.
+	h.links("proc/1/root/sys", map[string]map[string]string{
+		"lo":       {"operstate": "unknown", "ifindex": "1", "iflink": "1"},
+		"eth0":     {"operstate": "up", "ifindex": "2", "iflink": "2"},
+		"eth0.100": {"operstate": "up", "ifindex": "3", "iflink": "2"},
+	})
+	// Every pod has its eth0 at the same index, linked back to its own host veth.
+	for pid, hostIndex := range map[string]string{"100": "8", "200": "10", "300": "11"} {
+		h.links("proc/"+pid+"/root/sys", map[string]map[string]string{
+			"lo":   {"operstate": "unknown", "ifindex": "1", "iflink": "1"},
+			"eth0": {"operstate": "up", "ifindex": "3", "iflink": hostIndex},
+		})
+	}
+
+	h.links("sys", map[string]map[string]string{
+		"eth0":       {"operstate": "up", "ifindex": "2", "iflink": "2"},
+		"eth0.100":   {"operstate": "up", "ifindex": "3", "iflink": "2"},
+		"veth1a2b3c": {"operstate": "up", "ifindex": "8", "iflink": "3"},
+		"veth4d5e6f": {"operstate": "up", "ifindex": "10", "iflink": "3"},
+		"veth7a8b9c": {"operstate": "up", "ifindex": "11", "iflink": "3"},
+	})
+
+	d := h.newNetDev(func([]byte) bool { return true })
+	d.SetPeers(true)
+	d.ownNetns = "4026531992"
+	now := time.Unix(1700000000, 0)
+	ifaces, err := d.parse(strings.NewReader(vethData))
+	require.NoError(t, err)
+	d.readLinks(ifaces, now)
+	require.NoError(t, d.pairPeers(ifaces, now))
+
+	peers := make(map[string]Peer)
+	for _, iface := range ifaces {
+		peers[iface.Name] = iface.Peer
+	}
+	assert.Equal(t, map[string]Peer{
+		"eth0":       {},
+		"eth0.100":   {}, // Linked to eth0 in the host namespace.
+		"veth1a2b3c": {Netns: "4026532201", Name: "eth0"},
+		"veth4d5e6f": {Netns: "4026532300", Name: "eth0"},
+		"veth7a8b9c": {Netns: "4026532400", Name: "eth0"},
+	}, peers)
+
+	// A peer that isn't linked back to the veth is another interface at that index.
+	h.links("proc/300/root/sys", map[string]map[string]string{"eth0": {"iflink": "12"}})
+	now = now.Add(netnsRefresh)
+	ifaces, err = d.parse(strings.NewReader(vethData))
+	require.NoError(t, err)
+	d.readLinks(ifaces, now)
+	require.NoError(t, d.pairPeers(ifaces, now))
+	assert.Equal(t, "veth7a8b9c", ifaces[4].Name)
+	assert.Equal(t, Peer{}, ifaces[4].Peer)
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strconv"
+
+	"github.com/layer8co/toolbox/oslite"
+)
+
+// Route flags, from linux/route.h and linux/ipv6_route.h.
+const (
+	rtfUp     = 0x0001
+	rtfReject = 0x0200
+)
+
+const (
+	routeName     = hostProcName + "/net/route"
+	ipv6RouteName = hostProcName + "/net/ipv6_route"
+)
+
+// DefaultRoutes finds the interfaces that carry a default route,
+// from /proc/net/route and /proc/net/ipv6_route.
+// Its Match method is a MatchFunc that matches them.
+type DefaultRoutes struct {
+	logger *slog.Logger
+
+	names []string // Interfaces that carry a default route, sorted.
+	next  []string // Scratch space of Update.
+
+	scanBuf []byte
+	fields  [][]byte
+	file    *oslite.File
+
+	routePath, ipv6RoutePath string
+}
+
+// NewDefaultRoutes returns a DefaultRoutes that matches no interface until Update is called.
+// If logger is not nil, changes to the interfaces that carry a default route are logged to it.
+func NewDefaultRoutes(logger *slog.Logger) *DefaultRoutes {
+	r := &DefaultRoutes{
+		logger:  logger,
+		scanBuf: make([]byte, netdevMaxLineSize),
+		fields:  make([][]byte, 10),
+		file:    new(oslite.File),
+	}
+	r.setHost(hostProc)
+	return r
+}
+
+// setHost makes r read the procfs mounted on procDir.
+func (r *DefaultRoutes) setHost(procDir string) {
+	r.routePath = procDir + "/net/route"
+	r.ipv6RoutePath = procDir + "/net/ipv6_route"
+}
+
+// Match reports whether the named interface carries a default route.
+func (r *DefaultRoutes) Match(name []byte) bool {
+	for _, n := range r.names {
+		if n == string(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update reads the routing tables again.
+// A missing /proc/net/ipv6_route, as when IPv6 is disabled, is taken as empty.
+// Parsing them doesn't allocate when the interfaces that carry a default route are unchanged.
+func (r *DefaultRoutes) Update() error {
+	r.next = r.next[:0]
+	err := r.read(r.routePath, routeName, r.parseRoute)
+	if err != nil {
+		return err
+	}
+	err = r.read(r.ipv6RoutePath, ipv6RouteName, r.parseIPv6Route)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	r.commit()
+	return nil
+}
+
+// commit makes the interfaces found by the parse functions the current ones.
+func (r *DefaultRoutes) commit() {
+	slices.Sort(r.next)
+	r.next = slices.Compact(r.next)
+	if slices.Equal(r.names, r.next) {
+		return
+	}
+	r.names, r.next = r.next, r.names
+	if r.logger != nil {
+		r.logger.Info("default route interfaces changed", "ifaces", slices.Clone(r.names))
+	}
+}
+
+func (r *DefaultRoutes) read(path, name string, parse func(io.Reader, string) error) error {
+	err := r.file.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open file %q: %w", name, err)
+	}
+	defer r.file.Close()
+	return parse(r.file, name)
+}
+
+// parseRoute adds the interfaces of the default routes in /proc/net/route to r.next.
+// Its lines look like:
+//
+//	Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+//	eth0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+func (r *DefaultRoutes) parseRoute(rd io.Reader, name string) error {
+	const (
+		ifaceField = 0
+		destField  = 1
+		flagsField = 3
+		maskField  = 7
+	)
+	return r.scan(rd, name, 1, maskField+1, func(fields [][]byte) error {
+		if string(fields[destField]) != "00000000" || string(fields[maskField]) != "00000000" {
+			return nil
+		}
+		flags, err := parseFlags(fields[flagsField])
+		if err != nil {
+			return err
+		}
+		if flags&rtfUp != 0 && flags&rtfReject == 0 {
+			r.addName(fields[ifaceField])
+		}
+		return nil
+	})
+}
+
+// parseIPv6Route adds the interfaces of the default routes in /proc/net/ipv6_route to r.next.
+// Its lines have no header and look like:
+//
+//	00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0
+//
+// Default routes that are unreachable, which the kernel puts on lo, are left out.
+func (r *DefaultRoutes) parseIPv6Route(rd io.Reader, name string) error {
+	const (
+		destField      = 0
+		prefixLenField = 1
+		flagsField     = 8
+		ifaceField     = 9
+	)
+	return r.scan(rd, name, 0, ifaceField+1, func(fields [][]byte) error {
+		if string(fields[prefixLenField]) != "00" || len(bytes.Trim(fields[destField], "0")) != 0 {
+			return nil
+		}
+		flags, err := parseFlags(fields[flagsField])
+		if err != nil {
+			return err
+		}
+		if flags&rtfUp != 0 && flags&rtfReject == 0 && string(fields[ifaceField]) != "lo" {
+			r.addName(fields[ifaceField])
+		}
+		return nil
+	})
+}
+
+// scan calls fn with the fields of each line of rd after the header lines,
+// each of which must have at least n fields.
+func (r *DefaultRoutes) scan(rd io.Reader, name string, header, n int, fn func(fields [][]byte) error) error {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(r.scanBuf, cap(r.scanBuf))
+	fields := r.fields[:n]
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Bytes()
+		if lineNum <= header || len(line) == 0 {
+			continue
+		}
+		got := readFields(line, fields)
+		if got != n {
+			return fmt.Errorf("line %d of %q has %d fields, want at least %d", lineNum, name, got, n)
+		}
+		err := fn(fields)
+		if err != nil {
+			return fmt.Errorf("line %d of %q: %w", lineNum, name, err)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return fmt.Errorf("could not scan file %q: %w", name, err)
+	}
+	return nil
+}
+
+// addName adds name to r.next, reusing the string of r.names if it's there.
+func (r *DefaultRoutes) addName(name []byte) {
+	for _, n := range r.names {
+		if n == string(name) {
+			r.next = append(r.next, n)
+			return
+		}
+	}
+	r.next = append(r.next, string(name))
+}
+
+func parseFlags(b []byte) (int64, error) {
+	flags, err := strconv.ParseInt(string(b), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse route flags: %w", err)
+	}
+	return flags, nil
+}
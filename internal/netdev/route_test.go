@@ -0,0 +1,60 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const routeData = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wlan0	00000000	0102A8C0	0003	0	0	600	00000000	0	0	0
+wlan0	0002A8C0	00000000	0001	0	0	600	00FFFFFF	0	0	0
+eth1	00000000	0101A8C0	0002	0	0	100	00000000	0	0	0
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+`
+
+const ipv6RouteData = `fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001 eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200 lo
+`
+
+func TestDefaultRoutes(t *testing.T) {
+	h := newFakeHost(t)
+	h.write("proc/net/route", routeData)
+	h.write("proc/net/ipv6_route", ipv6RouteData)
+
+	r := h.newDefaultRoutes()
+	assert.False(t, r.Match([]byte("wlan0")))
+	require.NoError(t, r.Update())
+	// eth1's route is down, and lo's is unreachable.
+	assert.Equal(t, []string{"eth0", "wlan0"}, r.names)
+	assert.True(t, r.Match([]byte("wlan0")))
+	assert.False(t, r.Match([]byte("eth1")))
+	assert.False(t, r.Match([]byte("docker0")))
+
+	routeReader := strings.NewReader(routeData)
+	ipv6RouteReader := strings.NewReader(ipv6RouteData)
+	allocs := testing.AllocsPerRun(100, func() {
+		routeReader.Seek(0, io.SeekStart)
+		ipv6RouteReader.Seek(0, io.SeekStart)
+		r.next = r.next[:0]
+		r.parseRoute(routeReader, routeName)
+		r.parseIPv6Route(ipv6RouteReader, ipv6RouteName)
+		r.commit()
+	})
+	assert.Equal(t, float64(0), allocs)
+
+	// Without IPv6.
+	h.remove("proc/net/ipv6_route")
+	require.NoError(t, r.Update())
+	assert.Equal(t, []string{"wlan0"}, r.names)
+
+	h.write("proc/net/route", "header\neth0 00000000\n")
+	assert.Error(t, r.Update())
+}
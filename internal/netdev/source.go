@@ -0,0 +1,67 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import "time"
+
+// Snapshot holds the counters of the collected interfaces at a point in time.
+type Snapshot struct {
+	Time   time.Time
+	Ifaces []Iface
+}
+
+// Source reads the counters of network interfaces.
+// ProcfsSource and NetlinkSource are the Sources of the interfaces of the host.
+type Source interface {
+	// Read returns the counters of the interfaces collected from the source.
+	// The Ifaces of the snapshot are only valid until the next call to Read.
+	Read() (Snapshot, error)
+	// Close releases the resources held by the source.
+	Close() error
+}
+
+var (
+	_ Source = (*ProcfsSource)(nil)
+	_ Source = (*NetlinkSource)(nil)
+)
+
+// NewSource returns the Source of d that reads the counters from b.
+func NewSource(d *NetDev, b Backend) Source {
+	if b == BackendNetlink {
+		return NewNetlinkSource(d)
+	}
+	return NewProcfsSource(d)
+}
+
+// ProcfsSource is the Source of the interfaces of a NetDev
+// that parses /proc/net/dev, or the one of every network namespace (see NetDev.SetAllNetns).
+type ProcfsSource struct {
+	d *NetDev
+}
+
+// NewProcfsSource returns a ProcfsSource of d.
+func NewProcfsSource(d *NetDev) *ProcfsSource {
+	return &ProcfsSource{d: d}
+}
+
+// Read returns the counters and link details of each matched interface (see NetDev.Ifaces),
+// as of when they were read.
+func (s *ProcfsSource) Read() (Snapshot, error) {
+	return s.d.snapshot(s.d.parseProcfs)
+}
+
+// Close does nothing, as the files of procfs are only open while they are read.
+func (s *ProcfsSource) Close() error {
+	return nil
+}
+
+// snapshot reads the interfaces of d with parse (see read), as of now.
+func (d *NetDev) snapshot(parse func(now time.Time) ([]Iface, error)) (Snapshot, error) {
+	now := time.Now()
+	ifaces, err := d.read(now, parse)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Time: now, Ifaces: ifaces}, nil
+}
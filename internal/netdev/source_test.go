@@ -0,0 +1,50 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcfsSource(t *testing.T) {
+	h := newFakeHost(t)
+	h.processes(map[int]string{
+		1:  "4026531992",
+		42: "4026532201",
+	})
+	d := h.newNetDev(ifaceRegexp.Match)
+	d.SetAllNetns(true)
+	src := NewSource(d, BackendProcfs)
+	require.IsType(t, (*ProcfsSource)(nil), src)
+	defer src.Close()
+
+	before := time.Now()
+	snap, err := src.Read()
+	require.NoError(t, err)
+	assert.False(t, snap.Time.Before(before))
+	assert.False(t, snap.Time.After(time.Now()))
+	require.Len(t, snap.Ifaces, 2)
+	assert.Equal(t, "4026531992/eth0", snap.Ifaces[0].ID())
+	assert.Equal(t, "4026532201/eth0", snap.Ifaces[1].ID())
+}
+
+func TestNewSource(t *testing.T) {
+	d := New(ifaceRegexp.Match, nil)
+	assert.IsType(t, (*NetlinkSource)(nil), NewSource(d, BackendNetlink))
+}
+
+func BenchmarkReadProcfs(b *testing.B) {
+	s := NewProcfsSource(New(ifaceRegexp.Match, nil))
+	defer s.Close()
+	if _, err := s.Read(); err != nil {
+		b.Skipf("procfs is not available: %v", err)
+	}
+	for b.Loop() {
+		s.Read()
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const vlanConfigName = hostProcName + "/net/vlan/config"
+
+// Aggregation selects which of the matched interfaces that are stacked on each other,
+// e.g. a bond and its slaves, or a VLAN and its parent, are collected,
+// so that the same traffic isn't counted more than once.
+type Aggregation int
+
+const (
+	// AggregateAll collects every matched interface.
+	AggregateAll Aggregation = iota
+	// AggregateTopLevel leaves out the interfaces that a matched interface is stacked on,
+	// e.g. the slaves of a matched bond.
+	AggregateTopLevel
+	// AggregatePhysical leaves out the interfaces stacked on a matched interface,
+	// e.g. a bond of matched slaves, or the VLANs of a matched interface.
+	AggregatePhysical
+)
+
+var aggregationNames = []string{
+	AggregateAll:      "all",
+	AggregateTopLevel: "top-level",
+	AggregatePhysical: "physical",
+}
+
+func (a Aggregation) String() string {
+	if int(a) < len(aggregationNames) {
+		return aggregationNames[a]
+	}
+	return fmt.Sprintf("Aggregation(%d)", int(a))
+}
+
+func ParseAggregation(s string) (Aggregation, error) {
+	i := slices.Index(aggregationNames, s)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown aggregation %q", s)
+	}
+	return Aggregation(i), nil
+}
+
+// topology is how the network interfaces are stacked on each other.
+type topology struct {
+	// The interfaces each interface is directly stacked on, by name.
+	lowers map[string][]string
+
+	// Matched interfaces that it was read for, but doesn't know either,
+	// as when sysfs is of another network namespace than /proc/net/dev.
+	missing []string
+}
+
+// readTopology reads the topology of the network interfaces from
+// the master, lower_* and upper_* links of sysDir/* (/sys/class/net/*),
+// and from vlanConfig (/proc/net/vlan/config) if the 8021q module is loaded.
+func readTopology(sysDir, vlanConfig string) (*topology, error) {
+	t := &topology{lowers: make(map[string][]string)}
+	entries, err := os.ReadDir(sysDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read topology from %q: %w", sysClassNetName, err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if _, ok := t.lowers[name]; !ok {
+			t.lowers[name] = nil
+		}
+		links, err := os.ReadDir(filepath.Join(sysDir, name))
+		if err != nil {
+			// The interface went away.
+			continue
+		}
+		for _, l := range links {
+			if lower, ok := strings.CutPrefix(l.Name(), "lower_"); ok {
+				t.add(name, lower)
+			} else if upper, ok := strings.CutPrefix(l.Name(), "upper_"); ok {
+				t.add(upper, name)
+			}
+		}
+		master, err := os.Readlink(filepath.Join(sysDir, name, "master"))
+		if err == nil {
+			t.add(filepath.Base(master), name)
+		}
+	}
+	err = t.readVLANs(vlanConfig)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readVLANs adds the VLANs of /proc/net/vlan/config, whose lines look like:
+//
+//	VLAN Dev name	 | VLAN ID
+//	Name-Type: VLAN_NAME_TYPE_RAW_PLUS_VID_NO_PAD
+//	eth0.100       | 100  | eth0
+func (t *topology) readVLANs(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read VLANs from %q: %w", vlanConfigName, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if lineNum <= 2 {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) != 3 {
+			continue
+		}
+		t.add(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[2]))
+	}
+	return nil
+}
+
+// add records that upper is stacked on lower.
+func (t *topology) add(upper, lower string) {
+	if upper == "" || lower == "" || slices.Contains(t.lowers[upper], lower) {
+		return
+	}
+	t.lowers[upper] = append(t.lowers[upper], lower)
+	if _, ok := t.lowers[lower]; !ok {
+		t.lowers[lower] = nil
+	}
+}
+
+// Known reports whether the named interface existed when t was read.
+func (t *topology) Known(name string) bool {
+	_, ok := t.lowers[name]
+	return ok
+}
+
+// StackedOn reports whether upper is stacked on lower, directly or not.
+func (t *topology) StackedOn(upper, lower string) bool {
+	return t.stackedOn(upper, lower, 0)
+}
+
+// Deeper stacks than this are taken to be loops.
+const maxStackDepth = 8
+
+func (t *topology) stackedOn(upper, lower string, depth int) bool {
+	if depth == maxStackDepth {
+		return false
+	}
+	for _, l := range t.lowers[upper] {
+		if l == lower || t.stackedOn(l, lower, depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshTopology reads the topology again if d aggregates stacked interfaces
+// and it is out of date.
+func (d *NetDev) refreshTopology(now time.Time) error {
+	if d.aggregation == AggregateAll {
+		return nil
+	}
+	if d.topology != nil && !d.topologyStale && now.Sub(d.topologyRead) < linkRefresh {
+		return nil
+	}
+	t, err := readTopology(d.linkDir, d.vlanConfig)
+	if err != nil {
+		return err
+	}
+	// Interfaces it doesn't know either don't make it read again before it is out of date.
+	for _, iface := range d.ifaces {
+		if d.own(&iface) && !t.Known(iface.Name) {
+			t.missing = append(t.missing, iface.Name)
+		}
+	}
+	d.topology = t
+	d.topologyRead = now
+	d.topologyStale = false
+	return nil
+}
+
+// unstacked returns the interfaces of d.ifaces that are collected according to d.aggregation.
+func (d *NetDev) unstacked() []Iface {
+	if d.aggregation == AggregateAll || d.topology == nil {
+		return d.ifaces
+	}
+	d.collected = d.collected[:0]
+	for _, iface := range d.ifaces {
+		if !d.own(&iface) {
+			// The topology is only known in netexp's own network namespace.
+			d.collected = append(d.collected, iface)
+			continue
+		}
+		if !d.topology.Known(iface.Name) && !slices.Contains(d.topology.missing, iface.Name) {
+			d.topologyStale = true
+		}
+		if !d.hidden(iface.Name) {
+			d.collected = append(d.collected, iface)
+		}
+	}
+	return d.collected
+}
+
+// hidden reports whether the named interface is left out
+// because of another matched interface it is stacked with.
+func (d *NetDev) hidden(name string) bool {
+	for _, o := range d.ifaces {
+		if !d.own(&o) {
+			continue
+		}
+		switch d.aggregation {
+		case AggregateTopLevel:
+			if d.topology.StackedOn(o.Name, name) {
+				return true
+			}
+		case AggregatePhysical:
+			if d.topology.StackedOn(name, o.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package netdev
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const stackedData = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     100     1    0    0    0     0          0         0      100       1    0    0    0     0       0          0
+  eth0:     100     1    0    0    0     0          0         0      100       1    0    0    0     0       0          0
+  eth1:     200     1    0    0    0     0          0         0      200       1    0    0    0     0       0          0
+ bond0:     300     1    0    0    0     0          0         0      300       1    0    0    0     0       0          0
+bond0.100:  250     1    0    0    0     0          0         0      250       1    0    0    0     0       0          0
+ wlan0:     400     1    0    0    0     0          0         0      400       1    0    0    0     0       0          0
+`
+
+const vlanConfigData = `VLAN Dev name	 | VLAN ID
+Name-Type: VLAN_NAME_TYPE_RAW_PLUS_VID_NO_PAD
+bond0.100      | 100  | bond0
+`
+
+// fakeTopology returns a host with eth0 and eth1 enslaved to bond0,
+// with the VLAN bond0.100 on top, and the standalone wlan0 and lo.
+func fakeTopology(t *testing.T) *fakeHost {
+	t.Helper()
+	h := newFakeHost(t)
+	h.links("sys", map[string]map[string]string{
+		"lo": nil, "eth0": nil, "eth1": nil, "bond0": nil, "bond0.100": nil, "wlan0": nil,
+	})
+	link := func(name, file, target string) {
+		h.symlink("sys/class/net/"+name+"/"+file, "../"+target)
+	}
+	// Bond slaves have a master link, and upper_ links that older kernels lack.
+	link("eth0", "master", "bond0")
+	link("eth0", "upper_bond0", "bond0")
+	link("eth1", "master", "bond0")
+	link("bond0", "lower_eth0", "eth0")
+	link("bond0", "lower_eth1", "eth1")
+	h.write("proc/net/vlan/config", vlanConfigData)
+	return h
+}
+
+func TestReadTopology(t *testing.T) {
+	h := fakeTopology(t)
+	dir, vlanConfig := h.path("sys/class/net"), h.path("proc/net/vlan/config")
+	topo, err := readTopology(dir, vlanConfig)
+	require.NoError(t, err)
+
+	assert.True(t, topo.StackedOn("bond0", "eth0"))
+	assert.True(t, topo.StackedOn("bond0", "eth1"))
+	assert.True(t, topo.StackedOn("bond0.100", "bond0"))
+	assert.True(t, topo.StackedOn("bond0.100", "eth1"))
+	assert.False(t, topo.StackedOn("eth0", "bond0"))
+	assert.False(t, topo.StackedOn("wlan0", "eth0"))
+	assert.True(t, topo.Known("wlan0"))
+	assert.False(t, topo.Known("eth2"))
+
+	// Without the 8021q module loaded, there are no VLANs to read.
+	topo, err = readTopology(dir, h.path("proc/net/vlan/missing"))
+	require.NoError(t, err)
+	assert.False(t, topo.StackedOn("bond0.100", "bond0"))
+	assert.True(t, topo.StackedOn("bond0", "eth0"))
+
+	_, err = readTopology(filepath.Join(dir, "missing"), vlanConfig)
+	assert.Error(t, err)
+}
+
+func TestIfaces_Aggregation(t *testing.T) {
+	h := fakeTopology(t)
+	matchAll := func(name []byte) bool { return string(name) != "lo" }
+
+	tests := []struct {
+		aggregation Aggregation
+		want        []string
+	}{
+		{AggregateAll, []string{"eth0", "eth1", "bond0", "bond0.100", "wlan0"}},
+		{AggregateTopLevel, []string{"bond0.100", "wlan0"}},
+		{AggregatePhysical, []string{"eth0", "eth1", "wlan0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.aggregation.String(), func(t *testing.T) {
+			d := h.newNetDev(matchAll)
+			d.SetAggregation(tt.aggregation)
+			require.NoError(t, d.refreshTopology(time.Now()))
+			ifaces, err := d.parse(strings.NewReader(stackedData))
+			require.NoError(t, err)
+			var names []string
+			for _, iface := range ifaces {
+				names = append(names, iface.Name)
+			}
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
+
+func TestIfaces_AggregationUnmatchedUpper(t *testing.T) {
+	// The slaves of a bond that isn't matched are all collected.
+	d := fakeTopology(t).newNetDev(ifaceRegexp.Match)
+	d.SetAggregation(AggregateTopLevel)
+	require.NoError(t, d.refreshTopology(time.Now()))
+	ifaces, err := d.parse(strings.NewReader(stackedData))
+	require.NoError(t, err)
+	assert.Len(t, ifaces, 3)
+}
+
+func TestIfaces_AggregationRefresh(t *testing.T) {
+	d := fakeTopology(t).newNetDev(func(name []byte) bool { return string(name) != "lo" })
+	d.SetAggregation(AggregateTopLevel)
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, d.refreshTopology(now))
+	read := d.topology
+
+	// The topology is cached while every matched interface is known.
+	_, err := d.parse(strings.NewReader(stackedData))
+	require.NoError(t, err)
+	require.NoError(t, d.refreshTopology(now.Add(time.Second)))
+	assert.Same(t, read, d.topology)
+
+	// An interface it doesn't know makes it read again.
+	_, err = d.parse(strings.NewReader(stackedData + "  eth2:     1     1    0    0    0     0          0         0      1       1    0    0    0     0       0          0\n"))
+	require.NoError(t, err)
+	require.NoError(t, d.refreshTopology(now.Add(2*time.Second)))
+	assert.NotSame(t, read, d.topology)
+	read = d.topology
+
+	// One that is still missing from sysfs doesn't, until the topology is out of date.
+	_, err = d.parse(strings.NewReader(stackedData + "  eth2:     1     1    0    0    0     0          0         0      1       1    0    0    0     0       0          0\n"))
+	require.NoError(t, err)
+	require.NoError(t, d.refreshTopology(now.Add(3*time.Second)))
+	assert.Same(t, read, d.topology)
+	require.NoError(t, d.refreshTopology(now.Add(2*time.Second+linkRefresh)))
+	assert.NotSame(t, read, d.topology)
+}
+
+func TestParseAggregation(t *testing.T) {
+	for _, a := range []Aggregation{AggregateAll, AggregateTopLevel, AggregatePhysical} {
+		got, err := ParseAggregation(a.String())
+		assert.NoError(t, err)
+		assert.Equal(t, a, got)
+	}
+	_, err := ParseAggregation("bottom")
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package series
+
+// extremum tracks the maximum or minimum of the last n samples of a series
+// with a monotonic deque, in amortised O(1) time per sample.
+//
+// The deque holds the samples that can still become the extremum,
+// i.e. those that no newer sample dominates,
+// so its front is the extremum of the window.
+// Missing samples are never the minimum, and only the maximum
+// of a window that holds nothing but missing samples.
+type extremum struct {
+	n   int
+	min bool
+
+	// Ring buffer of the deque, holding the sequence number
+	// (see TimeSeries.seq) and the value of each sample.
+	seqs []int64
+	vals []int64
+	head int
+	len  int
+}
+
+func newExtremum(n int, min bool) *extremum {
+	return &extremum{
+		n:    n,
+		min:  min,
+		seqs: make([]int64, n),
+		vals: make([]int64, n),
+	}
+}
+
+// put adds the sample with sequence number seq,
+// which is one more than that of the previous sample.
+func (e *extremum) put(seq, v int64) {
+	for e.len > 0 && e.seqs[e.head] <= seq-int64(e.n) {
+		e.head = e.index(1)
+		e.len--
+	}
+	for e.len > 0 && e.dominates(v, e.vals[e.index(e.len-1)]) {
+		e.len--
+	}
+	if e.min && v == Missing {
+		return
+	}
+	i := e.index(e.len)
+	e.seqs[i] = seq
+	e.vals[i] = v
+	e.len++
+}
+
+// dominates reports whether v makes the older sample w irrelevant.
+func (e *extremum) dominates(v, w int64) bool {
+	if e.min {
+		return v != Missing && v <= w
+	}
+	return v >= w
+}
+
+// get returns the extremum of the window,
+// or !ok if it holds no sample that isn't missing.
+func (e *extremum) get() (v int64, ok bool) {
+	if e.len == 0 || e.vals[e.head] == Missing {
+		return 0, false
+	}
+	return e.vals[e.head], true
+}
+
+func (e *extremum) index(i int) int {
+	j := e.head + i
+	if j >= len(e.seqs) {
+		j -= len(e.seqs)
+	}
+	return j
+}
@@ -4,15 +4,43 @@
 package series
 
 import (
+	"fmt"
+	"math"
 	"slices"
 	"time"
 )
 
+// Missing is the value of samples that were skipped with Skip.
+const Missing int64 = math.MinInt64
+
 type TimeSeries struct {
-	Samples  []int64
 	Interval time.Duration
 
-	maxSamples int
+	// Ring buffer of the samples, the oldest of which is at samples[head].
+	samples []int64
+	head    int
+	len     int
+	seq     int64 // Number of samples put so far.
+
+	// Windows whose maximum or minimum is kept up to date as samples are put.
+	extrema []*extremum
+
+	scratch []int64 // Sorted samples for Quantiles.
+
+	counter      bool
+	started      bool
+	last         int64 // Last raw sample of a counter.
+	lastAdjusted int64 // Last sample of a counter, adjusted for resets.
+}
+
+// NewCounter returns a series for a cumulative counter.
+// Samples that are smaller than the previous one are taken as counter resets,
+// so the series holds the counter adjusted for resets and never decreases,
+// and Rate and Increase never go negative.
+func NewCounter(interval, window time.Duration) *TimeSeries {
+	s := New(interval, window)
+	s.counter = true
+	return s
 }
 
 func New(interval, window time.Duration) *TimeSeries {
@@ -28,19 +56,149 @@ func New(interval, window time.Duration) *TimeSeries {
 	maxIntervals := int(window / interval)
 	maxSamples := maxIntervals + 1
 	return &TimeSeries{
-		Samples:    make([]int64, 0, maxSamples),
-		maxSamples: maxSamples,
-		Interval:   interval,
+		samples:  make([]int64, maxSamples),
+		Interval: interval,
 	}
 }
 
+// window returns the longest duration that the series holds samples for.
+func (s *TimeSeries) window() time.Duration {
+	return time.Duration(len(s.samples)-1) * s.Interval
+}
+
+// Len returns the number of samples in the series.
+func (s *TimeSeries) Len() int {
+	return s.len
+}
+
+// AppendSamples appends the samples of the series to dst, from the oldest to the newest.
+func (s *TimeSeries) AppendSamples(dst []int64) []int64 {
+	a, b := s.newest(s.len)
+	return append(append(dst, a...), b...)
+}
+
+// index returns the position in the ring buffer of the i-th oldest sample.
+func (s *TimeSeries) index(i int) int {
+	j := s.head + i
+	if j >= len(s.samples) {
+		j -= len(s.samples)
+	}
+	return j
+}
+
+// newest returns the last n samples, which wrap around the ring buffer into b.
+func (s *TimeSeries) newest(n int) (a, b []int64) {
+	start := s.index(s.len - n)
+	end := start + n
+	if end <= len(s.samples) {
+		return s.samples[start:end], nil
+	}
+	return s.samples[start:], s.samples[:end-len(s.samples)]
+}
+
+// at returns the i-th sample counted back from the newest one, which is at(0).
+func (s *TimeSeries) at(i int) int64 {
+	return s.samples[s.index(s.len-1-i)]
+}
+
 func (s *TimeSeries) Put(sample int64) {
-	if len(s.Samples) < s.maxSamples {
-		s.Samples = append(s.Samples, sample)
-		return
+	if s.counter {
+		sample = s.adjust(sample)
+	}
+	s.put(sample)
+}
+
+// Skip records n intervals without a sample, e.g. while collection was failing.
+// Rate and Increase report that there aren't enough samples
+// when their duration reaches back into the gap,
+// and Max disregards the missing samples.
+func (s *TimeSeries) Skip(n int) {
+	for range min(n, len(s.samples)) {
+		s.put(Missing)
+	}
+}
+
+// put appends sample, overwriting the oldest one once the buffer is full.
+func (s *TimeSeries) put(sample int64) {
+	if s.len < len(s.samples) {
+		s.len++
+	} else {
+		s.head = s.index(1)
+	}
+	s.samples[s.index(s.len-1)] = sample
+	for _, e := range s.extrema {
+		e.put(s.seq, sample)
 	}
-	copy(s.Samples, s.Samples[1:])
-	s.Samples[len(s.Samples)-1] = sample
+	s.seq++
+}
+
+// TrackMax makes Max(d) take amortised O(1) time instead of scanning the last d duration,
+// at the cost of some work on every sample.
+// It has to be called before any sample is put.
+func (s *TimeSeries) TrackMax(d time.Duration) {
+	s.track(d, false)
+}
+
+// TrackMin is the equivalent of TrackMax for Min.
+func (s *TimeSeries) TrackMin(d time.Duration) {
+	s.track(d, true)
+}
+
+func (s *TimeSeries) track(d time.Duration, min bool) {
+	if s.seq > 0 {
+		panic("TimeSeries.Track: series already has samples")
+	}
+	n := s.windowSamples(d)
+	if n > len(s.samples) {
+		panic("TimeSeries.Track: duration is longer than the series")
+	}
+	if s.extremum(n, min) == nil {
+		s.extrema = append(s.extrema, newExtremum(n, min))
+	}
+}
+
+func (s *TimeSeries) extremum(n int, min bool) *extremum {
+	for _, e := range s.extrema {
+		if e.n == n && e.min == min {
+			return e
+		}
+	}
+	return nil
+}
+
+// windowSamples returns the number of samples in the last d duration.
+func (s *TimeSeries) windowSamples(d time.Duration) int {
+	if d < s.Interval {
+		panic("TimeSeries: duration must be at least one interval")
+	}
+	return int(d / s.Interval)
+}
+
+// adjust returns the counter sample adjusted for resets.
+// The increase over a gap left by Skip is added to the first sample after it.
+func (s *TimeSeries) adjust(sample int64) int64 {
+	if !s.started {
+		s.started = true
+		s.last = sample
+		s.lastAdjusted = sample
+		return sample
+	}
+	inc, _ := CounterIncrease(s.last, sample)
+	s.last = sample
+	s.lastAdjusted += inc
+	return s.lastAdjusted
+}
+
+// CounterIncrease returns how much a cumulative counter grew from prev to cur.
+// Like Prometheus' rate(), a decrease is taken as a reset of the counter,
+// e.g. the interface was re-created, the driver was reloaded,
+// or a 32-bit counter wrapped around,
+// and the counter is assumed to have restarted from zero.
+func CounterIncrease(prev, cur int64) (inc int64, reset bool) {
+	if cur < prev {
+		return cur, true
+	}
+	return cur - prev, false
 }
 
 // Rate returns the rate of change per second over the last d duration.
@@ -54,27 +212,189 @@ func (s *TimeSeries) Rate(d time.Duration) (diff int64, hasEnoughSamples bool) {
 	if d < s.Interval {
 		panic("TimeSeries.Diff: duration must be at least one interval")
 	}
+	diff, ok := s.Increase(d)
+	if !ok {
+		return 0, false
+	}
+	return int64(float64(diff) / d.Seconds()), true
+}
+
+// Increase returns how much the series has grown over the last d duration.
+// It is only applicable to cumulative series.
+//
+// Notes:
+//   - d must be >= s.Interval.
+//   - d is floored to the nearest multiple of s.interval.
+func (s *TimeSeries) Increase(d time.Duration) (diff int64, hasEnoughSamples bool) {
+	if d < s.Interval {
+		panic("TimeSeries.Increase: duration must be at least one interval")
+	}
 	intervals := int(d / s.Interval)
-	if intervals >= len(s.Samples) {
+	if intervals >= s.len {
+		return 0, false
+	}
+	new := s.at(0)
+	old := s.at(intervals)
+	if new == Missing || old == Missing {
 		return 0, false
 	}
-	new := s.Samples[len(s.Samples)-1]
-	old := s.Samples[len(s.Samples)-1-intervals]
-	return int64(float64(new-old) / d.Seconds()), true
+	return new - old, true
 }
 
-// Max returns the largest sample in the last d duration.
+// Max returns the largest sample in the last d duration,
+// disregarding missing samples.
+// It takes amortised O(1) time if d is tracked with TrackMax,
+// and scans the samples otherwise.
 //
 // Notes:
 //   - d must be >= s.Interval.
 //   - d is floored to the nearest multiple of s.interval.
 func (s *TimeSeries) Max(d time.Duration) (max int64, hasEnoughSamples bool) {
-	if d < s.Interval {
-		panic("TimeSeries.Max: duration must be at least one interval")
+	samples := s.windowSamples(d)
+	if samples > s.len {
+		return 0, false
+	}
+	if e := s.extremum(samples, false); e != nil {
+		return e.get()
 	}
-	samples := int(d / s.Interval)
-	if samples > len(s.Samples) {
+	a, b := s.newest(samples)
+	max = slices.Max(a)
+	if len(b) > 0 {
+		if m := slices.Max(b); m > max {
+			max = m
+		}
+	}
+	if max == Missing {
 		return 0, false
 	}
-	return slices.Max(s.Samples[len(s.Samples)-samples:]), true
+	return max, true
+}
+
+// Min returns the smallest sample in the last d duration,
+// disregarding missing samples.
+// It takes amortised O(1) time if d is tracked with TrackMin,
+// and scans the samples otherwise.
+//
+// Notes:
+//   - d must be >= s.Interval.
+//   - d is floored to the nearest multiple of s.interval.
+func (s *TimeSeries) Min(d time.Duration) (min int64, hasEnoughSamples bool) {
+	samples := s.windowSamples(d)
+	if samples > s.len {
+		return 0, false
+	}
+	if e := s.extremum(samples, true); e != nil {
+		return e.get()
+	}
+	a, b := s.newest(samples)
+	for _, samples := range [2][]int64{a, b} {
+		for _, v := range samples {
+			if v != Missing && (!hasEnoughSamples || v < min) {
+				min, hasEnoughSamples = v, true
+			}
+		}
+	}
+	return min, hasEnoughSamples
+}
+
+// Sum returns the sum of the samples in the last d duration,
+// disregarding missing samples.
+//
+// Notes:
+//   - d must be >= s.Interval.
+//   - d is floored to the nearest multiple of s.interval.
+func (s *TimeSeries) Sum(d time.Duration) (sum int64, hasEnoughSamples bool) {
+	samples := s.windowSamples(d)
+	if samples > s.len {
+		return 0, false
+	}
+	a, b := s.newest(samples)
+	for _, samples := range [2][]int64{a, b} {
+		for _, v := range samples {
+			if v != Missing {
+				sum, hasEnoughSamples = sum+v, true
+			}
+		}
+	}
+	return sum, hasEnoughSamples
+}
+
+// Quantiles sets dst[i] to the qs[i]-quantile of the samples in the last d duration,
+// disregarding missing samples.
+// Quantiles are exact, using the nearest-rank method:
+// the q-quantile of n samples is the ceil(q*n)-th smallest one,
+// or the smallest one for q == 0.
+// len(dst) has to be at least len(qs).
+//
+// Notes:
+//   - d must be >= s.Interval.
+//   - d is floored to the nearest multiple of s.interval.
+func (s *TimeSeries) Quantiles(d time.Duration, qs []float64, dst []int64) (hasEnoughSamples bool) {
+	samples := s.windowSamples(d)
+	if samples > s.len {
+		return false
+	}
+	if s.scratch == nil {
+		s.scratch = make([]int64, 0, len(s.samples))
+	}
+	a, b := s.newest(samples)
+	s.scratch = s.scratch[:0]
+	for _, samples := range [2][]int64{a, b} {
+		for _, v := range samples {
+			if v != Missing {
+				s.scratch = append(s.scratch, v)
+			}
+		}
+	}
+	n := len(s.scratch)
+	if n == 0 {
+		return false
+	}
+	slices.Sort(s.scratch)
+	for i, q := range qs {
+		rank := int(math.Ceil(q * float64(n)))
+		dst[i] = s.scratch[min(max(rank, 1), n)-1]
+	}
+	return true
+}
+
+// State is the state of a series, as saved across restarts.
+type State struct {
+	Interval time.Duration `json:"interval"`
+	Samples  []int64       `json:"samples"` // From the oldest to the newest.
+
+	// Counter state of series made with NewCounter.
+	Started      bool  `json:"started,omitempty"`
+	Last         int64 `json:"last,omitempty"`
+	LastAdjusted int64 `json:"last_adjusted,omitempty"`
+}
+
+// State returns the state of s.
+func (s *TimeSeries) State() State {
+	return State{
+		Interval:     s.Interval,
+		Samples:      s.AppendSamples(nil),
+		Started:      s.started,
+		Last:         s.last,
+		LastAdjusted: s.lastAdjusted,
+	}
+}
+
+// Restore puts the samples of st into s, which has to be empty,
+// keeping only as many of the newest ones as s holds.
+// The windows of s are tracked as usual, so it has to be called after TrackMax and TrackMin.
+func (s *TimeSeries) Restore(st State) error {
+	if s.seq > 0 {
+		panic("TimeSeries.Restore: series already has samples")
+	}
+	if st.Interval != s.Interval {
+		return fmt.Errorf("interval %s of the saved series is not %s", st.Interval, s.Interval)
+	}
+	for _, v := range st.Samples[max(0, len(st.Samples)-len(s.samples)):] {
+		s.put(v)
+	}
+	s.started = st.Started
+	s.last = st.Last
+	s.lastAdjusted = st.LastAdjusted
+	return nil
 }
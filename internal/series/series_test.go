@@ -35,7 +35,7 @@ func TestSeries(t *testing.T) {
 		30,
 		40,
 	}
-	assert.Equal(t, wantSamples, s.Samples)
+	assert.Equal(t, wantSamples, s.AppendSamples(nil))
 
 	assert.Panics(t, func() { s.Max(0) })
 	assert.Equal(t, int64(40), mustSeries(s.Max(1*time.Second)))
@@ -55,6 +55,226 @@ func TestSeries(t *testing.T) {
 	assert.Equal(t, int64(7), mustSeries(s.Rate(5*time.Second)))
 	_, hasEnoughSamples = s.Rate(6 * time.Second)
 	assert.Equal(t, false, hasEnoughSamples)
+
+	assert.Panics(t, func() { s.Increase(0) })
+	assert.Equal(t, int64(10), mustSeries(s.Increase(1*time.Second)))
+	assert.Equal(t, int64(-10), mustSeries(s.Increase(2*time.Second)))
+	assert.Equal(t, int64(37), mustSeries(s.Increase(5*time.Second)))
+	_, hasEnoughSamples = s.Increase(6 * time.Second)
+	assert.Equal(t, false, hasEnoughSamples)
+}
+
+func TestSeries_Counter(t *testing.T) {
+
+	s := series.NewCounter(
+		1*time.Second,
+		3*time.Second,
+	)
+
+	s.Put(100)
+	s.Put(150)
+	s.Put(20) // Reset.
+	s.Put(50)
+	s.Put(10) // Reset.
+
+	assert.Equal(t, []int64{150, 170, 200, 210}, s.AppendSamples(nil))
+	assert.Equal(t, int64(10), mustSeries(s.Rate(1*time.Second)))
+	assert.Equal(t, int64(20), mustSeries(s.Rate(2*time.Second)))
+	assert.Equal(t, int64(60), mustSeries(s.Increase(3*time.Second)))
+}
+
+func TestSeries_Skip(t *testing.T) {
+
+	s := series.NewCounter(
+		1*time.Second,
+		3*time.Second,
+	)
+
+	s.Put(10)
+	s.Put(20)
+	s.Skip(2)
+	s.Put(50)
+
+	_, hasEnoughSamples := s.Rate(1 * time.Second)
+	assert.Equal(t, false, hasEnoughSamples)
+	assert.Equal(t, int64(30), mustSeries(s.Increase(3*time.Second)))
+	assert.Equal(t, int64(50), mustSeries(s.Max(1*time.Second)))
+	assert.Equal(t, int64(50), mustSeries(s.Max(4*time.Second)))
+
+	s.Put(55)
+	assert.Equal(t, int64(5), mustSeries(s.Rate(1*time.Second)))
+
+	s.Skip(10)
+	_, hasEnoughSamples = s.Max(4 * time.Second)
+	assert.Equal(t, false, hasEnoughSamples)
+
+	s.Put(60)
+	assert.Equal(t, int64(60), mustSeries(s.Max(4*time.Second)))
+}
+
+func TestCounterIncrease(t *testing.T) {
+	inc, reset := series.CounterIncrease(10, 15)
+	assert.Equal(t, int64(5), inc)
+	assert.False(t, reset)
+	inc, reset = series.CounterIncrease(1<<32-10, 5)
+	assert.Equal(t, int64(5), inc)
+	assert.True(t, reset)
+}
+
+func TestSeries_Tracked(t *testing.T) {
+
+	windows := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second, 10 * time.Second}
+	tracked := series.New(time.Second, 10*time.Second)
+	scanned := series.New(time.Second, 10*time.Second)
+	for _, d := range windows {
+		tracked.TrackMax(d)
+		tracked.TrackMin(d)
+	}
+
+	// Pseudo-random samples with gaps.
+	x := int64(1)
+	for i := range 200 {
+		x = x * 48271 % 2147483647
+		if i%37 == 5 {
+			n := int(x % 4)
+			tracked.Skip(n)
+			scanned.Skip(n)
+			continue
+		}
+		tracked.Put(x % 1000)
+		scanned.Put(x % 1000)
+		for _, d := range windows {
+			wantMax, wantOk := scanned.Max(d)
+			gotMax, gotOk := tracked.Max(d)
+			assert.Equal(t, wantOk, gotOk, "max ok at sample %d over %s", i, d)
+			assert.Equal(t, wantMax, gotMax, "max at sample %d over %s", i, d)
+			wantMin, wantOk := scanned.Min(d)
+			gotMin, gotOk := tracked.Min(d)
+			assert.Equal(t, wantOk, gotOk, "min ok at sample %d over %s", i, d)
+			assert.Equal(t, wantMin, gotMin, "min at sample %d over %s", i, d)
+		}
+	}
+
+	assert.Panics(t, func() { tracked.TrackMax(2 * time.Second) })
+}
+
+func TestSeries_Min(t *testing.T) {
+	s := series.New(time.Second, 3*time.Second)
+	s.Put(5)
+	s.Skip(1)
+	s.Put(7)
+	assert.Equal(t, int64(5), mustSeries(s.Min(3*time.Second)))
+	assert.Equal(t, int64(7), mustSeries(s.Min(2*time.Second)))
+	s.Skip(2)
+	_, hasEnoughSamples := s.Min(2 * time.Second)
+	assert.Equal(t, false, hasEnoughSamples)
+}
+
+func TestSeries_Quantiles(t *testing.T) {
+	s := series.New(time.Second, 10*time.Second)
+	for _, v := range []int64{100, 7, 3, 9, 1, 5} {
+		s.Put(v)
+	}
+	s.Skip(1)
+	for _, v := range []int64{2, 8, 4, 6, 10} {
+		s.Put(v)
+	}
+
+	qs := []float64{0, 0.1, 0.5, 0.9, 0.99, 1}
+	got := make([]int64, len(qs))
+	assert.True(t, s.Quantiles(10*time.Second, qs, got))
+	assert.Equal(t, []int64{1, 1, 5, 10, 10, 10}, got)
+
+	assert.True(t, s.Quantiles(2*time.Second, qs[2:3], got))
+	assert.Equal(t, int64(6), got[0])
+
+	assert.False(t, s.Quantiles(time.Minute, qs, got))
+	s.Skip(3)
+	assert.False(t, s.Quantiles(3*time.Second, qs, got))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		s.Put(3)
+		s.Quantiles(10*time.Second, qs, got)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestSeries_State(t *testing.T) {
+	s := series.NewCounter(time.Second, 3*time.Second)
+	s.Put(100)
+	s.Put(150)
+	s.Skip(1)
+	s.Put(20) // Reset.
+	s.Put(50)
+
+	// The restored series is shorter, and keeps the newest samples.
+	r := series.NewCounter(time.Second, 2*time.Second)
+	r.TrackMax(2 * time.Second)
+	assert.NoError(t, r.Restore(s.State()))
+	assert.Equal(t, []int64{series.Missing, 170, 200}, r.AppendSamples(nil))
+	assert.Equal(t, int64(200), mustSeries(r.Max(2*time.Second)))
+
+	r.Put(60)
+	assert.Equal(t, int64(10), mustSeries(r.Increase(time.Second)))
+
+	err := series.New(2*time.Second, 4*time.Second).Restore(s.State())
+	assert.Error(t, err)
+}
+
+func TestSeries_NoAlloc(t *testing.T) {
+	s := series.NewCounter(time.Second, time.Minute)
+	var v int64
+	allocs := testing.AllocsPerRun(1000, func() {
+		v += 10
+		s.Put(v)
+		s.Rate(time.Second)
+		s.Max(time.Minute)
+	})
+	assert.Equal(t, float64(0), allocs)
+
+	s = series.New(time.Second, time.Minute)
+	s.TrackMax(time.Minute)
+	allocs = testing.AllocsPerRun(1000, func() {
+		v += 10
+		s.Put(v)
+		s.Max(time.Minute)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func BenchmarkPut(b *testing.B) {
+	s := series.New(100*time.Millisecond, time.Hour)
+	var v int64
+	for b.Loop() {
+		v++
+		s.Put(v)
+	}
+}
+
+// Put and Max over an hour of 100ms samples, as a burst series of metrics does every step.
+func BenchmarkMax(b *testing.B) {
+	for _, tracked := range []bool{false, true} {
+		name := "Scan"
+		if tracked {
+			name = "Deque"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := series.New(100*time.Millisecond, time.Hour)
+			if tracked {
+				s.TrackMax(time.Hour)
+			}
+			x := int64(1)
+			for range 36001 {
+				x = x * 48271 % 2147483647
+				s.Put(x)
+			}
+			for b.Loop() {
+				x = x * 48271 % 2147483647
+				s.Put(x)
+				s.Max(time.Hour)
+			}
+		})
+	}
 }
 
 func mustSeries[T any](v T, ok bool) T {
@@ -0,0 +1,345 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package series
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tier is a resolution at which a Tiered series keeps its samples, and for how long.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// Tiered is a series that keeps full resolution samples for recent data,
+// and the maximum, minimum, and sum of buckets of samples for older data,
+// like a round-robin database.
+// It answers Max and Min over long durations with bounded memory,
+// e.g. a week of 1 second samples can be kept as an hour of 1 second samples,
+// a day of 1 minute buckets, and a week of 1 hour buckets.
+//
+// Durations that are longer than the retention of the full resolution samples
+// are answered from the first tier that retains them,
+// and extended to a whole number of its buckets at their older end.
+type Tiered struct {
+	Interval time.Duration
+
+	full  *TimeSeries
+	tiers []tier
+}
+
+// tier holds the buckets of one coarser tier.
+type tier struct {
+	Tier
+	size          int // Full resolution samples per bucket.
+	max, min, sum *TimeSeries
+
+	// The bucket being filled.
+	n, present       int
+	bmax, bmin, bsum int64
+}
+
+// ValidateTiers reports whether tiers can be used with NewTiered.
+// The first tier is the full resolution one, whose resolution is the interval.
+// Each following tier has a resolution that is a multiple of the previous one,
+// and a longer retention.
+// Every retention is a multiple of its resolution.
+func ValidateTiers(interval time.Duration, tiers []Tier) error {
+	if interval <= 0 {
+		return errors.New("interval is not positive")
+	}
+	if len(tiers) == 0 {
+		return errors.New("no tiers")
+	}
+	if tiers[0].Resolution != interval {
+		return fmt.Errorf("resolution %s of the first tier is not the interval %s", tiers[0].Resolution, interval)
+	}
+	for i, t := range tiers {
+		if t.Retention <= 0 || t.Retention%t.Resolution != 0 {
+			return fmt.Errorf("retention %s is not a positive multiple of the resolution %s", t.Retention, t.Resolution)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := tiers[i-1]
+		if t.Resolution <= prev.Resolution || t.Resolution%prev.Resolution != 0 {
+			return fmt.Errorf("resolution %s is not a larger multiple of the previous resolution %s", t.Resolution, prev.Resolution)
+		}
+		if t.Retention <= prev.Retention {
+			return fmt.Errorf("retention %s is not longer than the previous retention %s", t.Retention, prev.Retention)
+		}
+	}
+	return nil
+}
+
+// NewTiered returns a tiered series, whose tiers have to be valid (see ValidateTiers).
+func NewTiered(interval time.Duration, tiers ...Tier) *Tiered {
+	err := ValidateTiers(interval, tiers)
+	if err != nil {
+		panic("series.NewTiered: " + err.Error())
+	}
+	s := &Tiered{
+		Interval: interval,
+		full:     New(interval, tiers[0].Retention),
+	}
+	for _, t := range tiers[1:] {
+		s.tiers = append(s.tiers, tier{
+			Tier: t,
+			size: int(t.Resolution / interval),
+			max:  New(t.Resolution, t.Retention),
+			min:  New(t.Resolution, t.Retention),
+			sum:  New(t.Resolution, t.Retention),
+		})
+	}
+	return s
+}
+
+// Retention returns the longest duration that s can answer for.
+func (s *Tiered) Retention() time.Duration {
+	if len(s.tiers) == 0 {
+		return s.full.window()
+	}
+	return s.tiers[len(s.tiers)-1].Retention
+}
+
+// Len returns the number of full resolution samples in the series.
+func (s *Tiered) Len() int {
+	return s.full.Len()
+}
+
+func (s *Tiered) Put(sample int64) {
+	s.full.Put(sample)
+	for i := range s.tiers {
+		s.tiers[i].put(sample)
+	}
+}
+
+// Skip records n intervals without a sample. See TimeSeries.Skip.
+func (s *Tiered) Skip(n int) {
+	s.full.Skip(n)
+	for i := range s.tiers {
+		t := &s.tiers[i]
+		for range min(n, t.size*len(t.max.samples)) {
+			t.put(Missing)
+		}
+	}
+}
+
+// TrackMax makes Max(d) take amortised O(1) time if d is within the full resolution samples.
+// See TimeSeries.TrackMax.
+func (s *Tiered) TrackMax(d time.Duration) {
+	if d <= s.full.window() {
+		s.full.TrackMax(d)
+	}
+}
+
+// Max returns the largest sample in the last d duration,
+// disregarding missing samples.
+//
+// Notes:
+//   - d must be >= s.Interval.
+//   - d is floored to the nearest multiple of s.Interval.
+func (s *Tiered) Max(d time.Duration) (max int64, hasEnoughSamples bool) {
+	t := s.tier(d)
+	if t == nil {
+		return s.full.Max(d)
+	}
+	span, ok := t.span(d)
+	if !ok {
+		return 0, false
+	}
+	if span > 0 {
+		max, hasEnoughSamples = t.max.Max(span)
+	}
+	if t.present > 0 && (!hasEnoughSamples || t.bmax > max) {
+		max, hasEnoughSamples = t.bmax, true
+	}
+	return max, hasEnoughSamples
+}
+
+// Min returns the smallest sample in the last d duration,
+// disregarding missing samples. See Max.
+func (s *Tiered) Min(d time.Duration) (min int64, hasEnoughSamples bool) {
+	t := s.tier(d)
+	if t == nil {
+		return s.full.Min(d)
+	}
+	span, ok := t.span(d)
+	if !ok {
+		return 0, false
+	}
+	if span > 0 {
+		min, hasEnoughSamples = t.min.Min(span)
+	}
+	if t.present > 0 && (!hasEnoughSamples || t.bmin < min) {
+		min, hasEnoughSamples = t.bmin, true
+	}
+	return min, hasEnoughSamples
+}
+
+// Sum returns the sum of the samples in the last d duration,
+// disregarding missing samples. See Max.
+func (s *Tiered) Sum(d time.Duration) (sum int64, hasEnoughSamples bool) {
+	t := s.tier(d)
+	if t == nil {
+		return s.full.Sum(d)
+	}
+	span, ok := t.span(d)
+	if !ok {
+		return 0, false
+	}
+	if span > 0 {
+		sum, hasEnoughSamples = t.sum.Sum(span)
+	}
+	if t.present > 0 {
+		sum, hasEnoughSamples = sum+t.bsum, true
+	}
+	return sum, hasEnoughSamples
+}
+
+// Quantiles sets dst to the quantiles of the samples in the last d duration,
+// or reports !hasEnoughSamples if d is longer than the retention of the full resolution samples,
+// as quantiles can't be told from buckets. See TimeSeries.Quantiles.
+func (s *Tiered) Quantiles(d time.Duration, qs []float64, dst []int64) (hasEnoughSamples bool) {
+	if s.tier(d) != nil {
+		return false
+	}
+	return s.full.Quantiles(d, qs, dst)
+}
+
+// tier returns the coarser tier that answers for d,
+// or nil if the full resolution samples do.
+func (s *Tiered) tier(d time.Duration) *tier {
+	s.full.windowSamples(d) // Panics if d is too short.
+	if d <= s.full.window() || len(s.tiers) == 0 {
+		return nil
+	}
+	for i := range s.tiers {
+		if d <= s.tiers[i].Retention {
+			return &s.tiers[i]
+		}
+	}
+	return &s.tiers[len(s.tiers)-1]
+}
+
+// put adds a full resolution sample to the bucket being filled,
+// and stores the bucket once it's full.
+func (t *tier) put(sample int64) {
+	if sample != Missing {
+		if t.present == 0 {
+			t.bmax, t.bmin, t.bsum = sample, sample, 0
+		}
+		t.bmax = max(t.bmax, sample)
+		t.bmin = min(t.bmin, sample)
+		t.bsum += sample
+		t.present++
+	}
+	t.n++
+	if t.n < t.size {
+		return
+	}
+	if t.present == 0 {
+		t.max.Skip(1)
+		t.min.Skip(1)
+		t.sum.Skip(1)
+	} else {
+		t.max.Put(t.bmax)
+		t.min.Put(t.bmin)
+		t.sum.Put(t.bsum)
+	}
+	t.n, t.present, t.bsum = 0, 0, 0
+}
+
+// span returns the duration of the stored buckets that the last d duration reaches back into,
+// besides the bucket being filled, or !ok if there aren't as many.
+func (t *tier) span(d time.Duration) (span time.Duration, ok bool) {
+	interval := t.Resolution / time.Duration(t.size)
+	need := int(d/interval) - t.n
+	buckets := max(0, (need+t.size-1)/t.size)
+	if buckets > t.max.Len() {
+		return 0, false
+	}
+	return time.Duration(buckets) * t.Resolution, true
+}
+
+// TieredState is the state of a tiered series, as saved across restarts.
+type TieredState struct {
+	Full  State       `json:"full"`
+	Tiers []TierState `json:"tiers,omitempty"`
+}
+
+// TierState is the state of a coarser tier of a tiered series.
+type TierState struct {
+	Resolution time.Duration `json:"resolution"`
+	Retention  time.Duration `json:"retention"`
+	Max        State         `json:"max"`
+	Min        State         `json:"min"`
+	Sum        State         `json:"sum"`
+
+	// The bucket being filled.
+	N       int   `json:"n"`
+	Present int   `json:"present"`
+	BMax    int64 `json:"bmax"`
+	BMin    int64 `json:"bmin"`
+	BSum    int64 `json:"bsum"`
+}
+
+// State returns the state of s.
+func (s *Tiered) State() TieredState {
+	st := TieredState{Full: s.full.State()}
+	for _, t := range s.tiers {
+		st.Tiers = append(st.Tiers, TierState{
+			Resolution: t.Resolution,
+			Retention:  t.Retention,
+			Max:        t.max.State(),
+			Min:        t.min.State(),
+			Sum:        t.sum.State(),
+			N:          t.n,
+			Present:    t.present,
+			BMax:       t.bmax,
+			BMin:       t.bmin,
+			BSum:       t.bsum,
+		})
+	}
+	return st
+}
+
+// Restore restores the state of s, which has to be empty and have the same tiers as the saved one
+// besides the retention of the full resolution samples.
+// If it fails, s has to be discarded. See TimeSeries.Restore.
+func (s *Tiered) Restore(st TieredState) error {
+	if len(st.Tiers) != len(s.tiers) {
+		return fmt.Errorf("saved series has %d tiers instead of %d", len(st.Tiers)+1, len(s.tiers)+1)
+	}
+	for i, ts := range st.Tiers {
+		t := s.tiers[i].Tier
+		if ts.Resolution != t.Resolution || ts.Retention != t.Retention {
+			return fmt.Errorf("saved tier %s for %s is not %s for %s", ts.Resolution, ts.Retention, t.Resolution, t.Retention)
+		}
+		if ts.N < 0 || ts.N >= s.tiers[i].size || ts.Present < 0 || ts.Present > ts.N {
+			return fmt.Errorf("saved tier %s for %s has an invalid bucket", ts.Resolution, ts.Retention)
+		}
+	}
+	err := s.full.Restore(st.Full)
+	if err != nil {
+		return err
+	}
+	for i, ts := range st.Tiers {
+		t := &s.tiers[i]
+		err := errors.Join(
+			t.max.Restore(ts.Max),
+			t.min.Restore(ts.Min),
+			t.sum.Restore(ts.Sum),
+		)
+		if err != nil {
+			return err
+		}
+		t.n, t.present = ts.N, ts.Present
+		t.bmax, t.bmin, t.bsum = ts.BMax, ts.BMin, ts.BSum
+	}
+	return nil
+}
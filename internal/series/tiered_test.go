@@ -0,0 +1,120 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package series_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/layer8co/netexp/internal/series"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiered(t *testing.T) {
+
+	tiers := []series.Tier{
+		{Resolution: 1 * time.Second, Retention: 10 * time.Second},
+		{Resolution: 5 * time.Second, Retention: 60 * time.Second},
+		{Resolution: 20 * time.Second, Retention: 200 * time.Second},
+	}
+	s := series.NewTiered(time.Second, tiers...)
+	ref := series.New(time.Second, 300*time.Second)
+
+	windows := []time.Duration{
+		5 * time.Second,
+		10 * time.Second,
+		11 * time.Second,
+		30 * time.Second,
+		60 * time.Second,
+		61 * time.Second,
+		150 * time.Second,
+		200 * time.Second,
+	}
+
+	// Pseudo-random samples with short gaps.
+	x := int64(1)
+	n := 0
+	for i := range 1000 {
+		x = x * 48271 % 2147483647
+		if i%53 == 7 {
+			gap := int(x % 4)
+			s.Skip(gap)
+			ref.Skip(gap)
+			n += gap
+			continue
+		}
+		s.Put(x % 1000)
+		ref.Put(x % 1000)
+		n++
+
+		for _, d := range windows {
+			// The window is extended to whole buckets of the tier that answers for it.
+			covered := d
+			for _, tier := range tiers[1:] {
+				if d > tiers[0].Retention && d <= tier.Retention {
+					size := int(tier.Resolution / time.Second)
+					partial := n % size
+					buckets := (int(d/time.Second) - partial + size - 1) / size
+					covered = time.Duration(partial+buckets*size) * time.Second
+					break
+				}
+			}
+			wantMax, wantOk := ref.Max(covered)
+			gotMax, gotOk := s.Max(d)
+			assert.Equal(t, wantOk, gotOk, "max ok after %d samples over %s", n, d)
+			assert.Equal(t, wantMax, gotMax, "max after %d samples over %s", n, d)
+			wantMin, wantOk := ref.Min(covered)
+			gotMin, gotOk := s.Min(d)
+			assert.Equal(t, wantOk, gotOk, "min ok after %d samples over %s", n, d)
+			assert.Equal(t, wantMin, gotMin, "min after %d samples over %s", n, d)
+			wantSum, wantOk := ref.Sum(covered)
+			gotSum, gotOk := s.Sum(d)
+			assert.Equal(t, wantOk, gotOk, "sum ok after %d samples over %s", n, d)
+			assert.Equal(t, wantSum, gotSum, "sum after %d samples over %s", n, d)
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func TestTiered_State(t *testing.T) {
+	tiers := []series.Tier{
+		{Resolution: 1 * time.Second, Retention: 10 * time.Second},
+		{Resolution: 5 * time.Second, Retention: 60 * time.Second},
+	}
+	s := series.NewTiered(time.Second, tiers...)
+	for i := range 47 {
+		s.Put(int64(i * 7 % 31))
+	}
+
+	r := series.NewTiered(time.Second, tiers...)
+	assert.NoError(t, r.Restore(s.State()))
+	for _, d := range []time.Duration{5 * time.Second, 30 * time.Second, 40 * time.Second} {
+		assert.Equal(t, mustSeries(s.Max(d)), mustSeries(r.Max(d)), "max over %s", d)
+		assert.Equal(t, mustSeries(s.Min(d)), mustSeries(r.Min(d)), "min over %s", d)
+		assert.Equal(t, mustSeries(s.Sum(d)), mustSeries(r.Sum(d)), "sum over %s", d)
+	}
+
+	other := series.NewTiered(time.Second, tiers[0], series.Tier{Resolution: 10 * time.Second, Retention: 60 * time.Second})
+	assert.Error(t, other.Restore(s.State()))
+}
+
+func TestValidateTiers(t *testing.T) {
+	valid := []series.Tier{
+		{Resolution: time.Second, Retention: time.Hour},
+		{Resolution: time.Minute, Retention: 24 * time.Hour},
+	}
+	assert.NoError(t, series.ValidateTiers(time.Second, valid))
+
+	for _, tiers := range [][]series.Tier{
+		nil,
+		{{Resolution: 2 * time.Second, Retention: time.Hour}},
+		{{Resolution: time.Second, Retention: 1500 * time.Millisecond}},
+		{valid[0], {Resolution: time.Second, Retention: 24 * time.Hour}},
+		{valid[0], {Resolution: time.Minute, Retention: time.Hour}},
+	} {
+		assert.Error(t, series.ValidateTiers(time.Second, tiers), "%v", tiers)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+// Package state saves netexp's state across restarts.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/layer8co/netexp/internal/metrics"
+)
+
+// Version is the version of the state file format.
+// It is increased whenever a change makes older files unreadable,
+// and files of any other version are not loaded.
+const Version = 1
+
+// File is the content of a state file.
+type File struct {
+	Version int            `json:"version"`
+	Saved   time.Time      `json:"saved"`
+	Metrics *metrics.State `json:"metrics,omitempty"`
+}
+
+// Save writes f to path, with the current version.
+// The file is replaced atomically, so that a crash while saving
+// leaves the previous state in place.
+func Save(path string, f *File) error {
+	f.Version = Version
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("could not encode state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not save state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("could not save state: %w", err)
+	}
+	return nil
+}
+
+// Load reads the state file at path.
+// If there's no such file, the error satisfies errors.Is(err, fs.ErrNotExist).
+func Load(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load state: %w", err)
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	err = json.Unmarshal(b, &header)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode state file %q: %w", path, err)
+	}
+	if header.Version != Version {
+		return nil, fmt.Errorf("state file %q has version %d, want %d", path, header.Version, Version)
+	}
+	f := new(File)
+	err = json.Unmarshal(b, f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode state file %q: %w", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package state
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/layer8co/netexp/internal/expfmt"
+	"github.com/layer8co/netexp/internal/metrics"
+	"github.com/layer8co/netexp/internal/netdev"
+)
+
+func TestSaveLoad(t *testing.T) {
+	c := metrics.Config{
+		Interval:      time.Second,
+		BurstWindows:  []time.Duration{1 * time.Second},
+		OutputWindows: []time.Duration{5 * time.Second},
+		Breakdown:     metrics.BreakdownBoth,
+	}
+	now := time.Unix(1700000000, 0)
+	step := func(m *metrics.Metrics, v int64) []byte {
+		now = now.Add(time.Second)
+		m.Step(now, []netdev.Iface{{
+			Name:  "eth0",
+			Stats: netdev.Stats{netdev.RecvBytes: v, netdev.TrnsBytes: 2 * v},
+		}})
+		return m.Append(nil, expfmt.FormatText)
+	}
+
+	m := metrics.New(c)
+	step(m, 100)
+	step(m, 200)
+	step(m, 250)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, Save(path, &File{Saved: now, Metrics: m.State()}))
+	f, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, Version, f.Version)
+
+	restored := metrics.New(c)
+	require.NoError(t, restored.Restore(f.Metrics))
+
+	saved := now
+	want := step(m, 300)
+	now = saved
+	got := step(restored, 300)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestLoad_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := Load(filepath.Join(dir, "missing.json"))
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	path := filepath.Join(dir, "state.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 999}`), 0o600))
+	_, err = Load(path)
+	assert.ErrorContains(t, err, "version 999")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o600))
+	_, err = Load(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,292 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+// Package web serves netexp's HTTP endpoint with optional TLS and basic auth,
+// configured by a web configuration file like that of the Prometheus exporter-toolkit.
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of a web configuration file.
+type Config struct {
+	TLSServerConfig *TLSConfig `yaml:"tls_server_config"`
+
+	// Bcrypt hashes of the passwords of each user.
+	// Basic auth is required if there are any.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+// TLSConfig holds the TLS settings of the server.
+// The certificate and key files are read again when they change.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// One of the names of tls.ClientAuthType, e.g. RequireAndVerifyClientCert.
+	ClientAuthType string `yaml:"client_auth_type"`
+	// CA certificates to verify client certificates with.
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// ParseConfig parses and validates the content of a web configuration file.
+func ParseConfig(b []byte) (*Config, error) {
+	c := new(Config)
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	err := d.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if t := c.TLSServerConfig; t != nil {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("tls_server_config needs both cert_file and key_file")
+		}
+		auth, ok := clientAuthTypes[t.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("unknown client_auth_type %q", t.ClientAuthType)
+		}
+		verifies := auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert
+		if verifies && t.ClientCAFile == "" {
+			return nil, fmt.Errorf("client_auth_type %s needs client_ca_file", t.ClientAuthType)
+		}
+	}
+	for user, hash := range c.BasicAuthUsers {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("password of user %q is not a bcrypt hash: %w", user, err)
+		}
+	}
+	return c, nil
+}
+
+// Server serves HTTP according to a web configuration file,
+// which is read again whenever it changes.
+type Server struct {
+	path string
+
+	mu      sync.Mutex
+	config  *Config
+	modTime time.Time
+	files   map[string]cachedFile
+
+	// Credentials that matched a hash, so that
+	// bcrypt doesn't run on every scrape.
+	verified map[[sha256.Size]byte]struct{}
+}
+
+type cachedFile struct {
+	modTime time.Time
+	content []byte
+}
+
+// NewServer reads the web configuration file at path.
+func NewServer(path string) (*Server, error) {
+	s := &Server{
+		path:     path,
+		files:    make(map[string]cachedFile),
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+	_, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// current returns the configuration, reading the file again if it changed.
+// If the changed file is invalid, the previous configuration is kept.
+func (s *Server) current() (*Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.path)
+	if err == nil && s.config != nil && info.ModTime().Equal(s.modTime) {
+		return s.config, nil
+	}
+	var c *Config
+	if err == nil {
+		var b []byte
+		b, err = os.ReadFile(s.path)
+		if err == nil {
+			c, err = ParseConfig(b)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("could not load web config file %q: %w", s.path, err)
+		if s.config != nil {
+			return s.config, err
+		}
+		return nil, err
+	}
+	s.config = c
+	s.modTime = info.ModTime()
+	clear(s.verified)
+	return c, nil
+}
+
+// ListenAndServe serves srv, requiring basic auth of its handler
+// and using TLS if the configuration has a tls_server_config.
+// Whether TLS is used is fixed when it's called.
+// Errors reloading the configuration are reported to srv.ErrorLog.
+func (s *Server) ListenAndServe(srv *http.Server) error {
+	c, err := s.current()
+	if err != nil {
+		return err
+	}
+	srv.Handler = s.handler(srv, srv.Handler)
+	if c.TLSServerConfig == nil {
+		return srv.ListenAndServe()
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.tlsConfig(srv)
+		},
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+func (s *Server) tlsConfig(srv *http.Server) (*tls.Config, error) {
+	c, err := s.current()
+	if err != nil {
+		logError(srv, err)
+	}
+	t := c.TLSServerConfig
+	if t == nil {
+		return nil, errors.New("tls_server_config was removed from the web config file")
+	}
+	certPEM, err := s.readFile(t.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := s.readFile(t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load key pair: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthTypes[t.ClientAuthType],
+	}
+	if t.ClientCAFile != "" {
+		caPEM, err := s.readFile(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates in %q", t.ClientCAFile)
+		}
+	}
+	return config, nil
+}
+
+// readFile returns the content of a file, reading it again only if it changed.
+func (s *Server) readFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[path]
+	if ok && f.modTime.Equal(info.ModTime()) {
+		return f.content, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+	s.files[path] = cachedFile{modTime: info.ModTime(), content: b}
+	return b, nil
+}
+
+// handler requires basic auth of h when the configuration has users.
+// Errors reloading the configuration are reported to srv.ErrorLog.
+func (s *Server) handler(srv *http.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := s.current()
+		if err != nil {
+			logError(srv, err)
+		}
+		if len(c.BasicAuthUsers) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if ok && s.verify(c, user, pass) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="netexp"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// dummyHash is compared against for unknown users,
+// so that they take as long to reject as known ones.
+var dummyHash = sync.OnceValue(func() []byte {
+	b, _ := bcrypt.GenerateFromPassword([]byte("netexp"), bcrypt.DefaultCost)
+	return b
+})
+
+// verify reports whether pass is the password of user.
+// Only matches are cached, so that failed attempts can't grow the cache.
+func (s *Server) verify(c *Config, user, pass string) bool {
+	key := sha256.Sum256(slices.Concat([]byte(user), []byte{0}, []byte(pass)))
+	s.mu.Lock()
+	_, ok := s.verified[key]
+	s.mu.Unlock()
+	if ok {
+		return true
+	}
+	hash, known := c.BasicAuthUsers[user]
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(pass))
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	if c == s.config {
+		s.verified[key] = struct{}{}
+	}
+	s.mu.Unlock()
+	return true
+}
+
+func logError(srv *http.Server, err error) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Print(err)
+	}
+}
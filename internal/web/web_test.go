@@ -0,0 +1,128 @@
+// Copyright 2023 the netexp authors.
+// SPDX-License-Identifier: MIT
+
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseConfig_Errors(t *testing.T) {
+	for _, s := range []string{
+		"bogus: 1",
+		"tls_server_config: {cert_file: a.crt}",
+		"tls_server_config: {cert_file: a.crt, key_file: a.key, client_auth_type: Bogus}",
+		"tls_server_config: {cert_file: a.crt, key_file: a.key, client_auth_type: RequireAndVerifyClientCert}",
+		"basic_auth_users: {alice: plaintext}",
+	} {
+		_, err := ParseConfig([]byte(s))
+		if err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	path := writeFile(t, "web.yml", "basic_auth_users:\n  alice: "+string(hash)+"\n")
+
+	s, err := NewServer(path)
+	require.NoError(t, err)
+	h := s.handler(new(http.Server), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		user, pass string
+		want       int
+	}{
+		{"alice", "secret", http.StatusOK},
+		{"alice", "secret", http.StatusOK}, // Cached.
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, tt.want, w.Code, "%s:%s", tt.user, tt.pass)
+	}
+}
+
+func TestTLS_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeKeyPair(t, certFile, keyFile, "first")
+	path := writeFile(t, "web.yml", "tls_server_config:\n  cert_file: "+certFile+"\n  key_file: "+keyFile+"\n")
+
+	s, err := NewServer(path)
+	require.NoError(t, err)
+	srv := new(http.Server)
+
+	c, err := s.tlsConfig(srv)
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, c))
+
+	// Make sure that the modification time changes.
+	time.Sleep(10 * time.Millisecond)
+	writeKeyPair(t, certFile, keyFile, "second")
+	c, err = s.tlsConfig(srv)
+	require.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, c))
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func writeKeyPair(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+}
+
+func commonName(t *testing.T, c *tls.Config) string {
+	t.Helper()
+	require.Len(t, c.Certificates, 1)
+	cert, err := x509.ParseCertificate(c.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	return cert.Subject.CommonName
+}